@@ -2,37 +2,68 @@ CREATE DATABASE exchange OWNER postgres;
 \connect exchange;
 CREATE TABLE IF NOT EXISTS account (
     uid varchar PRIMARY KEY,
-    balance float
+    balance numeric(20,6),
+    reserved numeric(20,6) NOT NULL DEFAULT 0, -- held by resting buys, part of balance
+    stp varchar NOT NULL DEFAULT '' -- default self-trade prevention mode
 );
 CREATE TABLE IF NOT EXISTS position (
     account_id varchar,
     symbol varchar,
-    amount float,
+    amount numeric(20,6),
     PRIMARY KEY(account_id, symbol)
 );
 CREATE TABLE IF NOT EXISTS buy_order (
     uid varchar PRIMARY KEY,
     account_id varchar,
     symbol varchar,
-    price_limit float,
-    amount float
+    price_limit numeric(20,6),
+    amount numeric(20,6),
+    reserved numeric(20,6),
+    seq bigint,
+    expires_at bigint
 );
 CREATE TABLE IF NOT EXISTS sell_order (
     uid varchar PRIMARY KEY,
     account_id varchar,
     symbol varchar,
-    price_limit float,
-    amount float
+    price_limit numeric(20,6),
+    amount numeric(20,6),
+    seq bigint,
+    expires_at bigint
 );
+CREATE TABLE IF NOT EXISTS journal_checkpoint (
+    id int PRIMARY KEY,
+    seq bigint
+);
+INSERT INTO journal_checkpoint VALUES (1, 0) ON CONFLICT DO NOTHING;
 CREATE TABLE IF NOT EXISTS symbol (
     name varchar PRIMARY KEY
 );
-CREATE TABLE IF NOT EXISTS transaction (
-    uid varchar PRIMARY KEY,
+CREATE TABLE IF NOT EXISTS execution (
+    trade_id bigint PRIMARY KEY,
+    buy_order_id varchar,
+    sell_order_id varchar,
+    buyer_id varchar,
+    seller_id varchar,
+    symbol varchar,
+    amount numeric(20,6),
+    price numeric(20,6),
+    executed_at varchar
+);
+CREATE INDEX IF NOT EXISTS execution_buy_order ON execution (buy_order_id);
+CREATE INDEX IF NOT EXISTS execution_sell_order ON execution (sell_order_id);
+CREATE TABLE IF NOT EXISTS order_event (
+    event_id bigserial PRIMARY KEY,
+    order_id varchar,
+    account_id varchar,
     symbol varchar,
-    amount float,
-    price float,
-    transaction_time varchar
+    event varchar,
+    amount numeric(20,6),
+    price numeric(20,6),
+    remaining numeric(20,6),
+    event_time varchar
 );
+CREATE INDEX IF NOT EXISTS order_event_order ON order_event (order_id);
+CREATE INDEX IF NOT EXISTS order_event_account ON order_event (account_id);
 CREATE INDEX buy_limit ON buy_order (price_limit);
 CREATE INDEX sell_limit ON sell_order (price_limit);
@@ -0,0 +1,329 @@
+// Package decimal implements the fixed-point numbers used for every cash
+// balance, share quantity and price in the exchange.
+//
+// A Decimal is stored as a whole number of micro-units (Scale digits after
+// the point), so adding and comparing are exact and no float64 ever touches
+// money. Text forms ("145.67") are used on the wire and in Postgres; Redis
+// stores the raw unit count so that balances and positions can be changed
+// atomically with HINCRBY.
+package decimal
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of digits kept after the decimal point.
+const Scale = 6
+
+const unitsPerOne = 1000000
+
+// MaxWhole bounds the magnitude of any number Parse accepts, so that two
+// parsed numbers can always be added or subtracted. Products can still
+// overflow; use CheckedMul where either side comes from a client.
+const MaxWhole = 1000000000000
+
+type Decimal struct {
+	units int64
+}
+
+var Zero = Decimal{}
+
+// Parse reads a plain decimal number such as "100", "-12.5" or "+0.000001".
+// Anything finer than Scale digits is rejected rather than rounded, and so
+// is anything larger than MaxWhole.
+func Parse(s string) (d Decimal, err error) {
+	return parse(s, MaxWhole*unitsPerOne)
+}
+
+// parse reads s as Parse does, up to max units in magnitude.
+func parse(s string, max int64) (d Decimal, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return d, fmt.Errorf("empty number")
+	}
+
+	neg := false
+	num := s
+	if num[0] == '-' || num[0] == '+' {
+		neg = num[0] == '-'
+		num = num[1:]
+	}
+
+	whole, frac := num, ""
+	if i := strings.IndexByte(num, '.'); i >= 0 {
+		whole, frac = num[:i], num[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return d, fmt.Errorf("invalid number %q", s)
+	}
+	if len(frac) > Scale {
+		if strings.TrimRight(frac[Scale:], "0") != "" {
+			return d, fmt.Errorf("%q has more than %d decimal places", s, Scale)
+		}
+		frac = frac[:Scale]
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return d, fmt.Errorf("invalid number %q", s)
+		}
+	}
+
+	if whole == "" {
+		whole = "0"
+	}
+	frac += strings.Repeat("0", Scale-len(frac))
+	units, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || units > max {
+		return d, fmt.Errorf("number %q out of range", s)
+	}
+	if neg {
+		units = -units
+	}
+	return Decimal{units}, nil
+}
+
+// FromInt returns the Decimal equal to the whole number i.
+func FromInt(i int64) Decimal {
+	return Decimal{i * unitsPerOne}
+}
+
+// FromUnits returns the Decimal holding the given number of micro-units.
+func FromUnits(units int64) Decimal {
+	return Decimal{units}
+}
+
+// Units is the raw micro-unit count, the form kept in Redis.
+func (d Decimal) Units() int64 {
+	return d.units
+}
+
+// String formats d without trailing zeros, e.g. "145.67", "-100", "0".
+func (d Decimal) String() string {
+	units := d.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	abs := new(big.Int).Abs(big.NewInt(units)).String()
+	if len(abs) <= Scale {
+		abs = strings.Repeat("0", Scale-len(abs)+1) + abs
+	}
+	whole, frac := abs[:len(abs)-Scale], strings.TrimRight(abs[len(abs)-Scale:], "0")
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// Add, Sub and Mul are for amounts already known to be in range; on
+// overflow their result is meaningless. The Checked forms report it.
+func (d Decimal) Add(o Decimal) Decimal {
+	return Decimal{d.units + o.units}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return Decimal{d.units - o.units}
+}
+
+// CheckedAdd returns d+o, and false if it does not fit.
+func (d Decimal) CheckedAdd(o Decimal) (Decimal, bool) {
+	sum := d.units + o.units
+	if (o.units > 0 && sum < d.units) || (o.units < 0 && sum > d.units) {
+		return Zero, false
+	}
+	return Decimal{sum}, true
+}
+
+// CheckedSub returns d-o, and false if it does not fit.
+func (d Decimal) CheckedSub(o Decimal) (Decimal, bool) {
+	diff := d.units - o.units
+	if (o.units > 0 && diff > d.units) || (o.units < 0 && diff < d.units) {
+		return Zero, false
+	}
+	return Decimal{diff}, true
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{-d.units}
+}
+
+func (d Decimal) Abs() Decimal {
+	if d.units < 0 {
+		return d.Neg()
+	}
+	return d
+}
+
+// Mul returns d*o rounded half away from zero to Scale digits.
+func (d Decimal) Mul(o Decimal) Decimal {
+	product, _ := d.CheckedMul(o)
+	return product
+}
+
+// CheckedMul returns d*o as Mul does, and false if it does not fit.
+func (d Decimal) CheckedMul(o Decimal) (Decimal, bool) {
+	p := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(o.units))
+	q := roundQuo(p, big.NewInt(unitsPerOne))
+	if !q.IsInt64() {
+		return Zero, false
+	}
+	return Decimal{q.Int64()}, true
+}
+
+// MulDiv returns d*n/q rounded half away from zero to Scale digits, without
+// the product overflowing on the way. q must not be zero; the result fits
+// whenever n is no larger than q.
+func (d Decimal) MulDiv(n Decimal, q Decimal) Decimal {
+	p := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(n.units))
+	return Decimal{roundQuo(p, big.NewInt(q.units)).Int64()}
+}
+
+// Div returns d/o truncated toward zero to Scale digits, so that buying
+// d/o shares never costs more than d. o must not be zero.
+func (d Decimal) Div(o Decimal) Decimal {
+	quotient, _ := d.CheckedDiv(o)
+	return quotient
+}
+
+// CheckedDiv returns d/o as Div does, and false if o is zero or the
+// quotient does not fit.
+func (d Decimal) CheckedDiv(o Decimal) (Decimal, bool) {
+	if o.units == 0 {
+		return Zero, false
+	}
+	n := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(unitsPerOne))
+	q := n.Quo(n, big.NewInt(o.units))
+	if !q.IsInt64() {
+		return Zero, false
+	}
+	return Decimal{q.Int64()}, true
+}
+
+// Floor drops any fractional part, toward zero.
+func (d Decimal) Floor() Decimal {
+	return Decimal{d.units / unitsPerOne * unitsPerOne}
+}
+
+func roundQuo(n *big.Int, div *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, div, new(big.Int))
+	if new(big.Int).Abs(new(big.Int).Lsh(r, 1)).Cmp(div) >= 0 {
+		if n.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// Cmp returns -1, 0 or +1 as d is less than, equal to or greater than o.
+func (d Decimal) Cmp(o Decimal) int {
+	switch {
+	case d.units < o.units:
+		return -1
+	case d.units > o.units:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+func (d Decimal) IsZero() bool {
+	return d.units == 0
+}
+
+func Min(a Decimal, b Decimal) Decimal {
+	if a.Cmp(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+// MARK: - Encoding
+
+// MarshalText lets encoding/xml and encoding/json write d as an attribute,
+// character data or string.
+func (d Decimal) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Decimal) UnmarshalText(text []byte) (err error) {
+	*d, err = Parse(string(text))
+	return
+}
+
+// UnmarshalJSON reads d from a JSON number or string, so that clients may
+// send either; d is always written back as a string.
+func (d *Decimal) UnmarshalJSON(data []byte) (err error) {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	*d, err = Parse(s)
+	return
+}
+
+// Value stores d in a NUMERIC column.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Scan reads a NUMERIC column. Stored amounts, such as a balance grown by
+// many trades, may be larger than Parse allows.
+func (d *Decimal) Scan(src interface{}) (err error) {
+	switch v := src.(type) {
+	case []byte:
+		*d, err = parse(string(v), math.MaxInt64)
+	case string:
+		*d, err = parse(v, math.MaxInt64)
+	case int64:
+		*d = FromInt(v)
+	case nil:
+		*d = Zero
+	default:
+		err = fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+	return
+}
+
+// RedisArg stores d in Redis as its unit count.
+func (d Decimal) RedisArg() interface{} {
+	return d.units
+}
+
+// RedisScan reads a unit count written by RedisArg.
+func (d *Decimal) RedisScan(src interface{}) (err error) {
+	switch v := src.(type) {
+	case []byte:
+		*d, err = ParseUnits(string(v))
+	case string:
+		*d, err = ParseUnits(v)
+	case int64:
+		*d = Decimal{v}
+	case nil:
+		*d = Zero
+	default:
+		err = fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+	return
+}
+
+// ParseUnits reads a unit count as stored in Redis.
+func ParseUnits(s string) (d Decimal, err error) {
+	units, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return d, fmt.Errorf("invalid unit count %q", s)
+	}
+	return Decimal{units}, nil
+}
@@ -0,0 +1,182 @@
+package decimal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in    string
+		units int64
+		err   bool
+	}{
+		{"100", 100000000, false},
+		{"-12.5", -12500000, false},
+		{"+0.000001", 1, false},
+		{" 7 ", 7000000, false},
+		{".5", 500000, false},
+		{"5.", 5000000, false},
+		{"-0", 0, false},
+		{"1.2500000", 1250000, false}, // zeros past Scale are not precision
+		{"1000000000000", MaxWhole * unitsPerOne, false},
+		{"-1000000000000", -MaxWhole * unitsPerOne, false},
+		{"0.0000001", 0, true},
+		{"1.0000005", 0, true},
+		{"1000000000000.000001", 0, true},
+		{"-1000000000000.000001", 0, true},
+		{"99999999999999999999", 0, true},
+		{"", 0, true},
+		{"-", 0, true},
+		{".", 0, true},
+		{"1e3", 0, true},
+		{"1.2.3", 0, true},
+		{"--1", 0, true},
+		{"0x10", 0, true},
+	}
+	for _, test := range tests {
+		d, err := Parse(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("Parse(%q) error %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if !test.err && d.Units() != test.units {
+			t.Errorf("Parse(%q) = %d units, want %d", test.in, d.Units(), test.units)
+		}
+	}
+}
+
+// Stored amounts may grow past what a client may send.
+func TestScanBeyondMaxWhole(t *testing.T) {
+	var d Decimal
+	if err := d.Scan([]byte("5000000000000.25")); err != nil || d.String() != "5000000000000.25" {
+		t.Errorf("Scan = %s, %v", d, err)
+	}
+	if err := d.Scan("10000000000000"); err == nil {
+		t.Errorf("Scan past int64 = %s, want an error", d)
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		units int64
+		want  string
+	}{
+		{0, "0"},
+		{1, "0.000001"},
+		{-1, "-0.000001"},
+		{145670000, "145.67"},
+		{-100000000, "-100"},
+		{math.MinInt64, "-9223372036854.775808"},
+	}
+	for _, test := range tests {
+		if got := FromUnits(test.units).String(); got != test.want {
+			t.Errorf("%d units = %s, want %s", test.units, got, test.want)
+		}
+	}
+}
+
+func TestMulRoundsHalfAwayFromZero(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"0.000001", "0.5", "0.000001"},
+		{"-0.000001", "0.5", "-0.000001"},
+		{"0.000001", "-0.5", "-0.000001"},
+		{"0.000001", "0.499999", "0"},
+		{"-0.000001", "0.499999", "0"},
+		{"1.5", "0.333333", "0.5"},
+		{"-1.5", "0.333333", "-0.5"},
+		{"0.5", "0.333333", "0.166667"},
+		{"0.333333", "3", "0.999999"},
+		{"12.5", "10", "125"},
+	}
+	for _, test := range tests {
+		a, b := mustParse(t, test.a), mustParse(t, test.b)
+		if got := a.Mul(b).String(); got != test.want {
+			t.Errorf("%s * %s = %s, want %s", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	tests := []struct {
+		d, n, q, want string
+	}{
+		{"0.5", "0.5", "1.5", "0.166667"},
+		{"0.333333", "0.5", "1", "0.166667"},
+		{"0.166666", "0.5", "0.5", "0.166666"},
+		{"10", "1", "3", "3.333333"},
+		{"20", "1", "3", "6.666667"},
+	}
+	for _, test := range tests {
+		d, n, q := mustParse(t, test.d), mustParse(t, test.n), mustParse(t, test.q)
+		if got := d.MulDiv(n, q).String(); got != test.want {
+			t.Errorf("%s * %s / %s = %s, want %s", test.d, test.n, test.q, got, test.want)
+		}
+	}
+	// the product of the largest amounts does not overflow on the way
+	max := FromUnits(math.MaxInt64)
+	if got := max.MulDiv(max, max); got != max {
+		t.Errorf("max * max / max = %s", got)
+	}
+}
+
+func TestOverflowDetected(t *testing.T) {
+	max, min, unit := FromUnits(math.MaxInt64), FromUnits(math.MinInt64), FromUnits(1)
+	huge := FromInt(MaxWhole)
+	tests := []struct {
+		name string
+		op   func() (Decimal, bool)
+		ok   bool
+	}{
+		{"add within range", func() (Decimal, bool) { return max.CheckedAdd(unit.Neg()) }, true},
+		{"add past max", func() (Decimal, bool) { return max.CheckedAdd(unit) }, false},
+		{"add past min", func() (Decimal, bool) { return min.CheckedAdd(unit.Neg()) }, false},
+		{"sub within range", func() (Decimal, bool) { return min.CheckedSub(unit.Neg()) }, true},
+		{"sub past min", func() (Decimal, bool) { return min.CheckedSub(unit) }, false},
+		{"sub past max", func() (Decimal, bool) { return max.CheckedSub(unit.Neg()) }, false},
+		{"sub negating min", func() (Decimal, bool) { return Zero.CheckedSub(min) }, false},
+		{"mul within range", func() (Decimal, bool) { return max.CheckedMul(FromInt(1)) }, true},
+		{"mul past max", func() (Decimal, bool) { return max.CheckedMul(mustParse(t, "1.000001")) }, false},
+		{"mul of two max wholes", func() (Decimal, bool) { return huge.CheckedMul(huge) }, false},
+		{"mul past min", func() (Decimal, bool) { return huge.CheckedMul(huge.Neg()) }, false},
+		{"div within range", func() (Decimal, bool) { return huge.CheckedDiv(mustParse(t, "0.5")) }, true},
+		{"div past max", func() (Decimal, bool) { return huge.CheckedDiv(unit) }, false},
+		{"div of max", func() (Decimal, bool) { return max.CheckedDiv(unit) }, false},
+		{"div past min", func() (Decimal, bool) { return max.CheckedDiv(unit.Neg()) }, false},
+		{"div by zero", func() (Decimal, bool) { return unit.CheckedDiv(Zero) }, false},
+	}
+	for _, test := range tests {
+		if _, ok := test.op(); ok != test.ok {
+			t.Errorf("%s: ok %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestDivTruncates(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"10", "3", "3.333333"},
+		{"-10", "3", "-3.333333"},
+		{"20", "3", "6.666666"},
+		{"1", "0.000001", "1000000"},
+		{"0.000001", "2", "0"},
+	}
+	for _, test := range tests {
+		a, b := mustParse(t, test.a), mustParse(t, test.b)
+		if got := a.Div(b).String(); got != test.want {
+			t.Errorf("%s / %s = %s, want %s", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) Decimal {
+	t.Helper()
+	d, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -12,7 +13,7 @@ var benchmarkLogFile *os.File
 
 func CreateBenchmarkingLog() {
 
-	file, err := os.OpenFile("/var/log/erss/benchmarks.csv", os.O_CREATE|os.O_WRONLY, 0666)
+	file, err := os.OpenFile(filepath.Join(config.LogDir, "benchmarks.csv"), os.O_CREATE|os.O_WRONLY, 0666)
 	if err == nil {
 		benchmarkLogFile = file
 	} else {
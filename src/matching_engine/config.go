@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config holds every setting that differs between deployments. Each one is
+// taken from, in increasing order of precedence: its default, the JSON
+// config file, an EME_* environment variable and a command line flag.
+type Config struct {
+	Listen           string
+	MarketDataListen string
+	Store            string
+	DBHost           string
+	DBUser           string
+	DBPassword       string
+	DBName           string
+	DBSSLMode        string
+	RedisHost        string
+	RedisMaxIdle     int
+	BufferCapacity   int
+	LogDir           string
+	JournalPath      string
+	AdminToken       string
+}
+
+var config = Config{
+	Listen:           "exchange:12345",
+	MarketDataListen: "exchange:12346",
+	Store:            storeRedis,
+	DBHost:           "db",
+	DBUser:           "postgres",
+	DBName:           "exchange",
+	DBSSLMode:        "disable",
+	RedisHost:        "redis:6379",
+	RedisMaxIdle:     3,
+	BufferCapacity:   30,
+	LogDir:           "/var/log/erss",
+	JournalPath:      "/var/lib/erss/journal.log",
+}
+
+// A setting is known by the same name in the config file and as a flag;
+// its environment variable is EME_ followed by the name in upper case with
+// dashes as underscores, e.g. db-host is EME_DB_HOST.
+type setting struct {
+	name  string
+	usage string
+	str   *string
+	num   *int
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{name: "listen", usage: "address to accept client connections on", str: &c.Listen},
+		{name: "market-data-listen", usage: "address to serve market data on, or \"\" for none", str: &c.MarketDataListen},
+		{name: "store", usage: "where exchange state is kept: \"redis\" (Redis and Postgres) or \"memory\" (in process, lost on exit)", str: &c.Store},
+		{name: "db-host", usage: "Postgres host", str: &c.DBHost},
+		{name: "db-user", usage: "Postgres user", str: &c.DBUser},
+		{name: "db-password", usage: "Postgres password", str: &c.DBPassword},
+		{name: "db-name", usage: "Postgres database", str: &c.DBName},
+		{name: "db-sslmode", usage: "Postgres sslmode", str: &c.DBSSLMode},
+		{name: "redis-host", usage: "Redis address (host:port)", str: &c.RedisHost},
+		{name: "redis-max-idle", usage: "idle connections kept in the Redis pool", num: &c.RedisMaxIdle},
+		{name: "buffer-capacity", usage: "journaled batches held before a flush to Postgres", num: &c.BufferCapacity},
+		{name: "log-dir", usage: "directory for exchange.log and benchmarks.csv", str: &c.LogDir},
+		{name: "journal-path", usage: "SQL journal file, must survive restarts", str: &c.JournalPath},
+		{name: "admin-token", usage: "token that permits <dump>, which is refused while it is unset", str: &c.AdminToken},
+	}
+}
+
+func (s setting) envName() string {
+	return "EME_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+func (s setting) set(value string) error {
+	if s.str != nil {
+		*s.str = value
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a number", s.name, value)
+	}
+	*s.num = n
+	return nil
+}
+
+func (s setting) String() string {
+	if s.str != nil {
+		return *s.str
+	}
+	return strconv.Itoa(*s.num)
+}
+
+// loadConfig fills in config from the file named by -config (or
+// EME_CONFIG), the environment and the flags in args. flags may already
+// define flags of its own, as reconcile does.
+func loadConfig(flags *flag.FlagSet, args []string) error {
+	settings := config.settings()
+	values := make(map[string]*string)
+	for _, s := range settings {
+		values[s.name] = flags.String(s.name, s.String(), s.usage)
+	}
+	path := flags.String("config", os.Getenv("EME_CONFIG"), "JSON config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *path != "" {
+		if err := config.readFile(*path); err != nil {
+			return err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.set(v); err != nil {
+				return fmt.Errorf("%s: %v", s.envName(), err)
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				err = s.set(*values[s.name])
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return config.validate()
+}
+
+// readFile applies a JSON object of setting names to values, e.g.
+// {"listen": "0.0.0.0:12345", "redis-max-idle": 10}.
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// numbers are kept as written, so 1000000 isn't read back as "1e+06"
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var file map[string]interface{}
+	if err = decoder.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	settings := c.settings()
+	for name, v := range file {
+		found := false
+		for _, s := range settings {
+			if s.name != name {
+				continue
+			}
+			found = true
+			if err = s.set(fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if c.MarketDataListen != "" {
+		if _, _, err := net.SplitHostPort(c.MarketDataListen); err != nil {
+			return fmt.Errorf("market-data-listen: %v", err)
+		}
+	}
+	if c.Store != storeRedis && c.Store != storeMemory {
+		return fmt.Errorf("store: unknown store %q", c.Store)
+	}
+	if c.LogDir == "" {
+		return fmt.Errorf("log-dir: must be set")
+	}
+	if c.Store == storeMemory {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(c.RedisHost); err != nil {
+		return fmt.Errorf("redis-host: %v", err)
+	}
+	if c.RedisMaxIdle < 1 {
+		return fmt.Errorf("redis-max-idle: must be at least 1, got %d", c.RedisMaxIdle)
+	}
+	if c.BufferCapacity < 1 {
+		return fmt.Errorf("buffer-capacity: must be at least 1, got %d", c.BufferCapacity)
+	}
+	if c.DBHost == "" || c.DBUser == "" || c.DBName == "" {
+		return fmt.Errorf("db-host, db-user and db-name must be set")
+	}
+	switch c.DBSSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("db-sslmode: unknown mode %q", c.DBSSLMode)
+	}
+	if c.JournalPath == "" || !filepath.IsAbs(c.JournalPath) {
+		return fmt.Errorf("journal-path: must be an absolute path, got %q", c.JournalPath)
+	}
+	return nil
+}
+
+// logConfig records the effective settings, without the secrets.
+func (c *Config) logConfig() {
+	fields := log.Fields{}
+	for _, s := range c.settings() {
+		if s.str == &c.DBPassword || s.str == &c.AdminToken {
+			if *s.str != "" {
+				fields[s.name] = "********"
+			}
+			continue
+		}
+		fields[s.name] = s.String()
+	}
+	log.WithFields(fields).Info("Configuration")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// <dump> returns the rows of every table, or of one, a page at a time. It
+// is only answered when its token matches the admin-token setting, and not
+// at all while that is unset.
+//
+//     <dump token="..." table="position" account="11" symbol="SPY" limit="50" after="..."/>
+//
+// Every attribute but the token is optional. Each table comes back with
+// next set if it has more rows; sending it as after, with the table named,
+// returns the page that follows.
+
+// A table as <dump> shows it
+type dumpTable struct {
+	name    string
+	columns []string
+	key     []string // unique; rows come in its order and pages are cut on it
+	account []string // columns the account filter matches, any of them
+	symbol  string   // column the symbol filter matches
+}
+
+var dumpTables = []dumpTable{
+	{name: "account", columns: []string{"uid", "balance", "reserved", "stp"}, key: []string{"uid"}, account: []string{"uid"}},
+	{name: "symbol", columns: []string{"name"}, key: []string{"name"}, symbol: "name"},
+	{name: "position", columns: []string{"account_id", "symbol", "amount"}, key: []string{"account_id", "symbol"}, account: []string{"account_id"}, symbol: "symbol"},
+	{name: "buy_order", columns: []string{"uid", "account_id", "symbol", "price_limit", "amount", "reserved", "seq", "expires_at"}, key: []string{"uid"}, account: []string{"account_id"}, symbol: "symbol"},
+	{name: "sell_order", columns: []string{"uid", "account_id", "symbol", "price_limit", "amount", "seq", "expires_at"}, key: []string{"uid"}, account: []string{"account_id"}, symbol: "symbol"},
+	{name: "execution", columns: []string{"trade_id", "buy_order_id", "sell_order_id", "buyer_id", "seller_id", "symbol", "amount", "price", "executed_at"}, key: []string{"trade_id"}, account: []string{"buyer_id", "seller_id"}, symbol: "symbol"},
+}
+
+// Rows a page holds unless the request asks for fewer, and at most
+const (
+	dumpDefaultLimit = 50
+	dumpMaxLimit     = 1000
+)
+
+// Which rows of a table to return: those matching the filters that are
+// set, after the row with key values after
+type dumpFilter struct {
+	account string
+	symbol  string
+	after   []string
+}
+
+// applies reports whether the filter can be used on t.
+func (f dumpFilter) applies(t dumpTable) bool {
+	return (f.account == "" || len(t.account) > 0) && (f.symbol == "" || t.symbol != "")
+}
+
+// keyOf returns the key values of a row of t.
+func (t dumpTable) keyOf(row []string) (key []string) {
+	for _, k := range t.key {
+		for i, column := range t.columns {
+			if column == k {
+				key = append(key, row[i])
+			}
+		}
+	}
+	return
+}
+
+// A cursor is the key of the last row of a page, opaque to clients.
+func encodeCursor(key []string) string {
+	data, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(t dumpTable, cursor string) (key []string, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &key)
+	}
+	if err != nil || len(key) != len(t.key) {
+		err = fmt.Errorf("Invalid cursor")
+	}
+	return
+}
+
+// isAdmin reports whether token is the admin token.
+func isAdmin(token string) bool {
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// handleDump returns a page of each table the request asks for. It must run
+// with the whole exchange locked, so that the tables agree with each other.
+func (d *Dump) handleDump(m Store) (resp DumpResponse, err error) {
+	log.Info("handle dump")
+	if !isAdmin(d.Token) {
+		err = fmt.Errorf("Not permitted")
+		return
+	}
+
+	limit := dumpDefaultLimit
+	if d.Limit != "" {
+		limit, err = strconv.Atoi(string(d.Limit))
+		if err != nil || limit < 1 || limit > dumpMaxLimit {
+			err = fmt.Errorf("Limit must be a whole number from 1 to %d", dumpMaxLimit)
+			return
+		}
+	}
+
+	filter := dumpFilter{account: d.Account, symbol: d.Symbol}
+	tables := dumpTables
+	if d.Table != "" {
+		tables = nil
+		for _, t := range dumpTables {
+			if t.name == d.Table {
+				tables = append(tables, t)
+			}
+		}
+		if len(tables) == 0 {
+			err = fmt.Errorf("Unknown table %s", d.Table)
+			return
+		}
+		if !filter.applies(tables[0]) {
+			err = fmt.Errorf("Table %s can't be filtered that way", d.Table)
+			return
+		}
+		if d.After != "" {
+			if filter.after, err = decodeCursor(tables[0], d.After); err != nil {
+				return
+			}
+		}
+	} else if d.After != "" {
+		err = fmt.Errorf("A cursor needs its table")
+		return
+	}
+
+	// rows earlier requests left waiting for Postgres belong in the dump; a
+	// dump writes nothing itself, so there is no batch of its own to commit
+	m.executeQueries()
+
+	for _, t := range tables {
+		if !filter.applies(t) {
+			continue
+		}
+		var rows [][]string
+		rows, err = m.dumpRows(t, filter, limit+1)
+		if err != nil {
+			return
+		}
+
+		table := DumpTableResponse{Name: t.name}
+		if len(rows) > limit {
+			rows = rows[:limit]
+			table.Next = encodeCursor(t.keyOf(rows[limit-1]))
+		}
+		for _, row := range rows {
+			var r DumpRowResponse
+			for i, column := range t.columns {
+				r.Columns = append(r.Columns, xml.Attr{Name: xml.Name{Local: column}, Value: row[i]})
+			}
+			table.Rows = append(table.Rows, r)
+		}
+		resp.Tables = append(resp.Tables, table)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often resting GTD orders are checked for expiry
+const expiryInterval = time.Second
+
+// runExpirer cancels GTD orders once their expiry passes. Expiries are kept
+// in the cache rather than in memory, so orders that expired while the
+// exchange was down are canceled as soon as it comes back.
+func runExpirer() {
+	for now := range time.Tick(expiryInterval) {
+		expireOrders(now)
+	}
+}
+
+func expireOrders(now time.Time) {
+	ids, err := SharedStore().getExpiredOrders(now)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to fetch expired orders")
+		return
+	}
+
+	var batches []*reportingBatch
+	for _, trId := range ids {
+		// same path as a <cancel>: refunds cash or shares and records the cancel
+		m := newReportingBatch()
+		locks := newLockSet()
+		locks.order(m, trId, true)
+		unlock := locks.lock()
+		acct, err := cancelOpenOrder(m, trId, eventCancel)
+		m.commitBatch()
+		m.captureMarketData(locks)
+		unlock()
+		batches = append(batches, m)
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"transId": trId,
+				"error":   err,
+			}).Error("Failed to expire order")
+			// don't retry a broken order every tick
+			SharedStore().clearOrderExpiry(trId)
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"transId": trId,
+			"account": acct,
+		}).Info("Expired GTD order")
+	}
+	if len(ids) > 0 {
+		SharedStore().syncJournal()
+	}
+	for _, m := range batches {
+		m.publish()
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Journal is an append-only log of the SQL queued for Postgres. Each entry
+// holds the statements of one request, which Postgres applies as a single
+// transaction. Entries are numbered in the order they are queued; Postgres
+// records the last number it has applied in journal_checkpoint, in that same
+// transaction, so replaying the journal applies each entry exactly once.
+type Journal struct {
+	mux    sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	seq    uint64 // last sequence number appended
+}
+
+// sqlCommand is a statement with $n placeholders and the values bound to
+// them. Values are kept as text, which Postgres converts to the column type,
+// so a command reads back from the journal exactly as it was queued.
+type sqlCommand struct {
+	Query string   `json:"query"`
+	Args  []string `json:"args,omitempty"`
+}
+
+func newSQLCommand(query string, args ...interface{}) sqlCommand {
+	cmd := sqlCommand{Query: query}
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, fmt.Sprint(arg))
+	}
+	return cmd
+}
+
+// args returns the bound values in the form database/sql expects.
+func (cmd sqlCommand) args() []interface{} {
+	args := make([]interface{}, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = arg
+	}
+	return args
+}
+
+// journalEntry is one numbered batch of statements, as it is queued and as
+// it is written.
+type journalEntry struct {
+	seq     uint64
+	queries []sqlCommand
+}
+
+func OpenJournal(path string) (j *Journal, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	j = &Journal{file: file, writer: bufio.NewWriter(file)}
+	return
+}
+
+// entries reads back every statement in the journal, in order. A torn final
+// line, left by a crash in the middle of a write, is ignored: it was never
+// synced, so its request was never acknowledged, and it is cut off so that
+// the next append starts on a fresh line.
+func (j *Journal) entries() (entries []journalEntry, err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if _, err = j.file.Seek(0, 0); err != nil {
+		return
+	}
+	reader := bufio.NewReader(j.file)
+	var size int64
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil {
+			if line != "" {
+				log.WithFields(log.Fields{
+					"line": line,
+				}).Warn("Ignoring incomplete journal entry")
+				err = j.file.Truncate(size)
+			}
+			break
+		}
+		size += int64(len(line))
+
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Malformed journal entry: %s", line)
+		}
+		seq, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed journal entry: %s", line)
+		}
+		var queries []sqlCommand
+		if err := json.Unmarshal([]byte(fields[1]), &queries); err != nil {
+			return nil, fmt.Errorf("Malformed journal entry: %s", line)
+		}
+		entries = append(entries, journalEntry{seq, queries})
+		if seq > j.seq {
+			j.seq = seq
+		}
+	}
+	return
+}
+
+// append numbers a batch and buffers it for the next Sync.
+func (j *Journal) append(queries []sqlCommand) (entry journalEntry, err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	encoded, err := json.Marshal(queries)
+	if err != nil {
+		return
+	}
+	j.seq++
+	entry = journalEntry{j.seq, queries}
+	_, err = fmt.Fprintf(j.writer, "%d %s\n", entry.seq, encoded)
+	return
+}
+
+// Sync makes every appended statement durable. Responses must not be sent
+// until it returns.
+func (j *Journal) Sync() (err error) {
+	defer LogMethodTimeElapsed("journal.Sync", time.Now())
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if err = j.writer.Flush(); err != nil {
+		return
+	}
+	return j.file.Sync()
+}
+
+// truncateThrough empties the journal once Postgres has applied everything
+// up to seq, provided nothing newer has been appended in the meantime.
+func (j *Journal) truncateThrough(seq uint64) (err error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if seq < j.seq || j.writer.Buffered() > 0 {
+		return
+	}
+	if err = j.file.Truncate(0); err != nil {
+		return
+	}
+	return j.file.Sync()
+}
+
+// startAfter makes sure new statements are numbered past seq, which Postgres
+// may already have applied even though the journal no longer holds it.
+func (j *Journal) startAfter(seq uint64) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if seq > j.seq {
+		j.seq = seq
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Each symbol's book, and each account's balance, has its own lock. A
+// request takes the locks for everything it reads or changes, in key order
+// so two requests can never wait on each other, and keeps them until its
+// batch is committed. Requests on different symbols and accounts therefore
+// run in parallel, while each book and balance still sees its requests one
+// at a time and in journal order.
+//
+// A trade also credits the resting order's account, which the request does
+// not lock: cash to a resting seller, shares to a resting buyer (whose
+// reservation it also draws down). That is safe because every one of those
+// changes is an increment (HINCRBY in the cache, amount+$1 or an upsert
+// adding to the row in Postgres), so they commute with anything a
+// concurrent request does to the same account. Nor do they take away what
+// that request may have checked: the seller's cash and the buyer's shares
+// only rise, and the buyer pays out of what its own order reserved.
+var (
+	key_locks     = make(map[string]*sync.RWMutex)
+	key_locks_mux sync.Mutex
+)
+
+func keyLock(key string) *sync.RWMutex {
+	key_locks_mux.Lock()
+	defer key_locks_mux.Unlock()
+	l, ok := key_locks[key]
+	if !ok {
+		l = new(sync.RWMutex)
+		key_locks[key] = l
+	}
+	return l
+}
+
+// lockSet is the locks a request needs, by key, and whether it writes
+// under each one. exclusive asks for the whole exchange instead, for a
+// request whose keys could not all be worked out up front.
+type lockSet struct {
+	keys      map[string]bool
+	exclusive bool
+}
+
+func newLockSet() *lockSet {
+	return &lockSet{keys: make(map[string]bool)}
+}
+
+func (s *lockSet) add(key string, write bool) {
+	s.keys[key] = s.keys[key] || write
+}
+
+func (s *lockSet) symbol(sym string, write bool) {
+	s.add("sym:"+sym, write)
+}
+
+func (s *lockSet) account(id string, write bool) {
+	s.add("acct:"+id, write)
+}
+
+// order locks the book and account of an existing order. An unknown id may
+// be an order another request is creating right now, so it can only be
+// handled with everything locked.
+func (s *lockSet) order(m Store, id string, write bool) {
+	info, err := m.getOrder(id)
+	if err != nil {
+		s.exclusive = true
+		return
+	}
+	s.symbol(info.symbol, write)
+	s.account(info.account, write)
+}
+
+// lock takes every lock in the set and returns the function that releases
+// them.
+func (s *lockSet) lock() (unlock func()) {
+	if s.exclusive {
+		match_mux.Lock()
+		return match_mux.Unlock
+	}
+	match_mux.RLock()
+
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	held := make([]func(), 0, len(keys))
+	for _, key := range keys {
+		l := keyLock(key)
+		if s.keys[key] {
+			l.Lock()
+			held = append(held, l.Unlock)
+		} else {
+			l.RLock()
+			held = append(held, l.RUnlock)
+		}
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i]()
+		}
+		match_mux.RUnlock()
+	}
+}
+
+// locks works out the locks a request needs before it is carried out.
+// Commands that did not decode need none, as they only report an error.
+func (r *request) locks(m Store) *lockSet {
+	s := newLockSet()
+	for _, cmd := range r.commands {
+		switch args := cmd.args.(type) {
+		case *Account:
+			s.account(args.Id, true)
+		case *Symbol:
+			s.symbol(args.Sym, true)
+			// the accounts given positions in it
+			for _, acct := range args.Accounts {
+				s.account(acct.Id, true)
+			}
+		case *Order:
+			s.account(r.account, true)
+			s.symbol(args.Sym, true)
+		case *Cancel:
+			s.account(r.account, true)
+			s.order(m, args.TransactionID, true)
+		case *Replace:
+			s.account(r.account, true)
+			s.order(m, args.TransactionID, true)
+		case *Subscribe, *Balance, *Positions, *Orders:
+			s.account(r.account, false)
+		case *Query:
+			s.account(r.account, false)
+			s.order(m, args.TransactionID, false)
+		case *Book:
+			s.symbol(args.Sym, false)
+		case *Dump:
+			// anyone else's is refused without locking anything
+			if isAdmin(args.Token) {
+				s.exclusive = true
+			}
+		}
+	}
+	return s
+}
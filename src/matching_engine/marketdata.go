@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Market data is served on its own port (market-data-listen), framed like
+// requests. A client sends <subscribe sym="..."/> and is sent a <snapshot>
+// of the symbol's last trade, best bid and ask, and depth by price level,
+// then an <update> with what changed every time a request trades in or
+// changes the book. A symbol's updates are numbered one after another from
+// its snapshot's seq; <unsubscribe sym="..."/> ends them.
+//
+// Changes are captured while the request still holds the symbol's lock, so
+// they are numbered in the order they were made, but like responses they
+// are only sent once journaled. Updates that are journaled out of turn are
+// held back until the ones before them have been sent.
+type symbolFeed struct {
+	sym string
+
+	// the book as of the last update numbered
+	captured   uint64
+	bids, asks []depthLevel
+
+	// the book as of the last update sent, which is what subscribers have
+	published     uint64
+	publishedBids []depthLevel
+	publishedAsks []depthLevel
+	lastTrade     *MarketDataTrade
+	pending       map[uint64]*MarketDataUpdate
+	subscribers   map[*Connection]bool
+}
+
+var (
+	feeds     = make(map[string]*symbolFeed)
+	feeds_mux sync.Mutex
+)
+
+// feedFor returns the feed of sym, which starts out as an empty book if
+// this is the first time it is needed. feeds_mux must be held.
+func feedFor(sym string) (feed *symbolFeed, created bool) {
+	feed, ok := feeds[sym]
+	if !ok {
+		feed = &symbolFeed{
+			sym:         sym,
+			pending:     make(map[uint64]*MarketDataUpdate),
+			subscribers: make(map[*Connection]bool),
+		}
+		feeds[sym] = feed
+	}
+	return feed, !ok
+}
+
+// queueTrade adds a trade to the market data of the batch's request.
+func queueTrade(m Store, sym string, trade MarketDataTrade) {
+	b, ok := m.(*reportingBatch)
+	if !ok {
+		return
+	}
+	if b.trades == nil {
+		b.trades = make(map[string][]MarketDataTrade)
+	}
+	b.trades[sym] = append(b.trades[sym], trade)
+}
+
+// changedBooks returns the loaded books a request may have changed: those it
+// holds for writing, or every one if it holds the whole exchange.
+func changedBooks(locks *lockSet) (changed []*OrderBook) {
+	if locks.exclusive {
+		books_mux.Lock()
+		defer books_mux.Unlock()
+		for _, book := range books {
+			changed = append(changed, book)
+		}
+		return
+	}
+	for key, write := range locks.keys {
+		if !write || !strings.HasPrefix(key, "sym:") {
+			continue
+		}
+		if book, ok := loadedBook(strings.TrimPrefix(key, "sym:")); ok {
+			changed = append(changed, book)
+		}
+	}
+	return
+}
+
+// captureMarketData numbers an update for each book the batch traded in or
+// changed. It must be called with the batch's locks still held.
+func (b *reportingBatch) captureMarketData(locks *lockSet) {
+	for _, book := range changedBooks(locks) {
+		bids, asks := book.depth(true), book.depth(false)
+
+		feeds_mux.Lock()
+		feed, _ := feedFor(book.sym)
+		update := &MarketDataUpdate{Sym: book.sym, Trades: b.trades[book.sym], bids: bids, asks: asks}
+		update.Levels = append(levelChanges("bid", feed.bids, bids), levelChanges("ask", feed.asks, asks)...)
+		if !sameLevel(top(feed.bids), top(bids)) || !sameLevel(top(feed.asks), top(asks)) {
+			quote := quoteOf(bids, asks)
+			update.Quote = &quote
+		}
+		if len(update.Trades) > 0 || len(update.Levels) > 0 {
+			feed.captured++
+			update.Seq = feed.captured
+			feed.bids, feed.asks = bids, asks
+			b.updates = append(b.updates, update)
+		}
+		feeds_mux.Unlock()
+	}
+}
+
+// publishMarketData sends each update to its symbol's subscribers, in
+// order.
+func publishMarketData(updates []*MarketDataUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	feeds_mux.Lock()
+	defer feeds_mux.Unlock()
+
+	for _, update := range updates {
+		feed, _ := feedFor(update.Sym)
+		feed.pending[update.Seq] = update
+		for {
+			next, ok := feed.pending[feed.published+1]
+			if !ok {
+				break
+			}
+			delete(feed.pending, next.Seq)
+			feed.published = next.Seq
+			feed.publishedBids, feed.publishedAsks = next.bids, next.asks
+			if len(next.Trades) > 0 {
+				feed.lastTrade = &next.Trades[len(next.Trades)-1]
+			}
+			if len(feed.subscribers) == 0 {
+				continue
+			}
+			if update_string, err := xml.MarshalIndent(next, "", "    "); err == nil {
+				update_string = append(update_string, '\n')
+				for c := range feed.subscribers {
+					c.Push(update_string)
+				}
+			}
+		}
+	}
+}
+
+// snapshot is what subscribers have been sent of the feed so far.
+func (feed *symbolFeed) snapshot() MarketDataSnapshot {
+	snap := MarketDataSnapshot{Sym: feed.sym, Seq: feed.published, Trade: feed.lastTrade, Quote: quoteOf(feed.publishedBids, feed.publishedAsks)}
+	snap.Levels = append(levelChanges("bid", nil, feed.publishedBids), levelChanges("ask", nil, feed.publishedAsks)...)
+	return snap
+}
+
+// levelChanges lists the levels of one side that differ between before and
+// after; a level that is gone is listed with no shares.
+func levelChanges(side string, before []depthLevel, after []depthLevel) (changes []MarketDataLevel) {
+	old := make(map[string]depthLevel)
+	for _, level := range before {
+		old[level.price.String()] = level
+	}
+	for _, level := range after {
+		prev, ok := old[level.price.String()]
+		delete(old, level.price.String())
+		if ok && sameLevel(&prev, &level) {
+			continue
+		}
+		changes = append(changes, MarketDataLevel{XMLName: xml.Name{Local: side}, Price: level.price, Shares: level.shares, Orders: level.orders})
+	}
+	for _, level := range before {
+		if _, gone := old[level.price.String()]; gone {
+			changes = append(changes, MarketDataLevel{XMLName: xml.Name{Local: side}, Price: level.price})
+		}
+	}
+	return
+}
+
+func top(levels []depthLevel) *depthLevel {
+	if len(levels) == 0 {
+		return nil
+	}
+	return &levels[0]
+}
+
+func sameLevel(a *depthLevel, b *depthLevel) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.price.Cmp(b.price) == 0 && a.shares.Cmp(b.shares) == 0 && a.orders == b.orders
+}
+
+func quoteOf(bids []depthLevel, asks []depthLevel) (quote MarketDataQuote) {
+	if bid := top(bids); bid != nil {
+		quote.Bid, quote.BidShares = &bid.price, &bid.shares
+	}
+	if ask := top(asks); ask != nil {
+		quote.Ask, quote.AskShares = &ask.price, &ask.shares
+	}
+	return
+}
+
+// handleMarketDataRequest subscribes or unsubscribes c from a symbol.
+func (c *Connection) handleMarketDataRequest(req []byte) {
+	defer LogMethodTimeElapsed("marketdata.handleMarketDataRequest", time.Now())
+
+	var r MarketDataRequest
+	err := xml.Unmarshal(req, &r)
+	if err == nil && r.Sym == "" {
+		err = fmt.Errorf("Symbol is required")
+	}
+	if err == nil {
+		switch r.XMLName.Local {
+		case "subscribe":
+			c.subscribeMarketData(r.Sym)
+			return
+		case "unsubscribe":
+			c.unsubscribeMarketData(r.Sym)
+			return
+		default:
+			err = fmt.Errorf("Unknown request %s", r.XMLName.Local)
+		}
+	}
+
+	fail := ErrorCreateResponse{Sym: r.Sym, Reason: err.Error()}
+	if fail_string, err := xml.MarshalIndent(fail, "", "    "); err == nil {
+		c.Push(append(fail_string, '\n'))
+	}
+}
+
+// subscribeMarketData sends c a snapshot of sym followed by its updates.
+func (c *Connection) subscribeMarketData(sym string) {
+	// the book can't change while it is read
+	locks := newLockSet()
+	locks.symbol(sym, false)
+	unlock := locks.lock()
+	defer unlock()
+	book := getBook(sym)
+
+	feeds_mux.Lock()
+	defer feeds_mux.Unlock()
+
+	feed, created := feedFor(sym)
+	if created {
+		// nothing has been captured, so the book is as it was loaded
+		feed.bids, feed.asks = book.depth(true), book.depth(false)
+		feed.publishedBids, feed.publishedAsks = feed.bids, feed.asks
+	}
+	feed.subscribers[c] = true
+	if c.symbols == nil {
+		c.symbols = make(map[string]bool)
+	}
+	c.symbols[sym] = true
+
+	log.WithFields(log.Fields{
+		"sym":    sym,
+		"seq":    feed.published,
+		"remote": c.conn.RemoteAddr(),
+	}).Info("Subscribed to market data")
+
+	if snap_string, err := xml.MarshalIndent(feed.snapshot(), "", "    "); err == nil {
+		c.Push(append(snap_string, '\n'))
+	}
+}
+
+// unsubscribeMarketData stops the updates of sym to c, or of every symbol
+// if sym is empty.
+func (c *Connection) unsubscribeMarketData(sym string) {
+	feeds_mux.Lock()
+	defer feeds_mux.Unlock()
+
+	for subscribed := range c.symbols {
+		if sym == "" || sym == subscribed {
+			delete(feeds[subscribed].subscribers, c)
+			delete(c.symbols, subscribed)
+		}
+	}
+	if sym != "" {
+		resp := UnsubscribedResponse{Sym: sym}
+		if resp_string, err := xml.MarshalIndent(resp, "", "    "); err == nil {
+			c.Push(append(resp_string, '\n'))
+		}
+	}
+}
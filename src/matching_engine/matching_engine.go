@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/farice/EME/redis"
 	log "github.com/sirupsen/logrus"
@@ -34,36 +36,41 @@ func init() {
 	// Log as JSON instead of the default ASCII formatter.
 	//log.SetFormatter(&log.JSONFormatter{})
 
-	// You could set this to any `io.Writer` such as a file
-	file, err := os.OpenFile("/var/log/erss/exchange.log", os.O_CREATE|os.O_WRONLY, 0666)
-	if err == nil {
-		log.SetOutput(file)
-	} else {
-		log.Info("Failed to log to file, using default stdout")
-	}
-
 	log.AddHook(&StdOutHook{})
 
 	// Only log the warning severity or above.
 	//log.SetLevel(log.WarnLevel)
+}
 
-	// MARK: - Global Transaction ID Counter
-
-	ex, err := redis.Exists("TransactionCounter")
-	if !ex {
-		redis.Set("TransactionCounter", 0)
+// openLogs sends the log to exchange.log in the configured log directory.
+func openLogs() {
+	file, err := os.OpenFile(filepath.Join(config.LogDir, "exchange.log"), os.O_CREATE|os.O_WRONLY, 0666)
+	if err == nil {
+		log.SetOutput(file)
+	} else {
+		log.Info("Failed to log to file, using default stdout")
 	}
-
 }
 
 func main() {
+	// matching_engine reconcile [-repair=cache|db]
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(runReconcile(os.Args[2:]))
+	}
+
+	if err := loadConfig(flag.CommandLine, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	openLogs()
+	config.logConfig()
+
 	var clientCount = 0
 
 	// Set up logging for performance benchmarking
 	CreateBenchmarkingLog()
 
-	// addr: exchange, port: 12345
-	server := NewTCPServer("exchange:12345")
+	server := NewTCPServer(config.Listen)
 
 	// MARK: - Implement new client, message, and closed connection callbacks
 
@@ -84,6 +91,8 @@ func main() {
 	})
 
 	server.OnClientConnectionClosed(func(c *Connection, err error) {
+		c.unsubscribe()
+
 		// Lost connection with Client
 		log.WithFields(log.Fields{
 			"error": err,
@@ -91,5 +100,38 @@ func main() {
 
 	})
 
+	switch config.Store {
+	case storeRedis:
+		redis.Init(config.RedisHost, config.RedisMaxIdle)
+		initCounters()
+
+		// apply anything acknowledged before the last shutdown but never written
+		if err := SharedModel().recoverJournal(config.JournalPath); err != nil {
+			log.Fatal("Failed to recover SQL journal: ", err)
+		}
+
+		// Postgres is now complete, so fill in anything the cache lost
+		if _, err := SharedModel().warmCache(); err != nil {
+			log.Fatal("Failed to warm cache from Postgres: ", err)
+		}
+		store = SharedModel()
+	case storeMemory:
+		store = NewMemoryStore()
+	}
+
+	// cancel GTD orders as they expire
+	go runExpirer()
+
+	if config.MarketDataListen != "" {
+		feed := NewTCPServer(config.MarketDataListen)
+		feed.OnNewMessage(func(c *Connection, message []byte) {
+			c.handleMarketDataRequest(message)
+		})
+		feed.OnClientConnectionClosed(func(c *Connection, err error) {
+			c.unsubscribeMarketData("")
+		})
+		go feed.Listen()
+	}
+
 	server.Listen()
 }
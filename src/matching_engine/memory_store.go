@@ -0,0 +1,499 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/farice/EME/decimal"
+)
+
+// A stored order: what the cache keeps in its order: hash
+type memoryOrder struct {
+	info orderInfo
+	seq  uint64
+	open bool // resting in the book
+}
+
+// An account's cash, how much of it resting buys have reserved, and its
+// self-trade prevention mode
+type memoryAccount struct {
+	balance  decimal.Decimal
+	reserved decimal.Decimal
+	stp      string
+}
+
+// A trade, as the execution table keeps it
+type memoryExecution struct {
+	id            int
+	buyID, sellID string
+	buyer, seller string
+	symbol        string
+	shares, price decimal.Decimal
+	time          string
+}
+
+// MemoryStore is a Store that keeps everything in process. It behaves like
+// the Redis and Postgres store as far as request handling can tell, which
+// makes it suitable for running the exchange in tests without any services.
+type MemoryStore struct {
+	mux         sync.Mutex
+	accounts    map[string]*memoryAccount
+	positions   map[string]map[string]decimal.Decimal
+	symbols     map[string]bool
+	orders      map[string]*memoryOrder
+	expiries    map[string]time.Time
+	events      map[string][]orderEvent
+	executions  []memoryExecution
+	transaction int
+	trade       int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:  make(map[string]*memoryAccount),
+		positions: make(map[string]map[string]decimal.Decimal),
+		symbols:   make(map[string]bool),
+		orders:    make(map[string]*memoryOrder),
+		expiries:  make(map[string]time.Time),
+		events:    make(map[string][]orderEvent),
+	}
+}
+
+// Changes apply immediately and nothing needs to be made durable
+func (s *MemoryStore) beginBatch() Store { return s }
+func (s *MemoryStore) commitBatch()      {}
+func (s *MemoryStore) executeQueries()   {}
+func (s *MemoryStore) syncJournal()      {}
+
+/// Counters
+
+func (s *MemoryStore) incTransactionCounter() (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.transaction++
+	return s.transaction, nil
+}
+
+/// Accounts
+
+func (s *MemoryStore) createAccount(uid string, balance decimal.Decimal, stp string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if uid == "" {
+		return nil
+	}
+	if _, ok := s.accounts[uid]; ok {
+		return fmt.Errorf("Duplicate account")
+	}
+	s.accounts[uid] = &memoryAccount{balance: balance, stp: stp}
+	return nil
+}
+
+func (s *MemoryStore) getSelfTradePrevention(accountID string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	acct, ok := s.accounts[accountID]
+	if !ok {
+		return "", fmt.Errorf("Account does not exist")
+	}
+	return acct.stp, nil
+}
+
+func (s *MemoryStore) getAccountBalance(accountID string) (decimal.Decimal, error) {
+	balance, _, err := s.getAccountFunds(accountID)
+	return balance, err
+}
+
+func (s *MemoryStore) getAccountFunds(accountID string) (balance decimal.Decimal, reserved decimal.Decimal, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	acct, ok := s.accounts[accountID]
+	if !ok {
+		err = fmt.Errorf("Account does not exist")
+		return
+	}
+	return acct.balance, acct.reserved, nil
+}
+
+func (s *MemoryStore) addAccountBalance(accountID string, amount decimal.Decimal) error {
+	return s.releaseFunds(accountID, decimal.Zero, amount.Neg())
+}
+
+func (s *MemoryStore) reserveFunds(accountID string, amount decimal.Decimal) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	acct, ok := s.accounts[accountID]
+	if !ok {
+		return fmt.Errorf("Account does not exist")
+	}
+	if amount.Cmp(acct.balance.Sub(acct.reserved)) > 0 {
+		return fmt.Errorf("Insufficient funds")
+	}
+	acct.reserved = acct.reserved.Add(amount)
+	return nil
+}
+
+func (s *MemoryStore) releaseFunds(accountID string, released decimal.Decimal, spent decimal.Decimal) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	acct, ok := s.accounts[accountID]
+	if !ok {
+		return fmt.Errorf("Account does not exist")
+	}
+	acct.reserved = acct.reserved.Sub(released)
+	acct.balance = acct.balance.Sub(spent)
+	return nil
+}
+
+func (s *MemoryStore) accountExists(accountID string) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.accounts[accountID]
+	return ok, nil
+}
+
+/// Positions
+
+func (s *MemoryStore) createOrUpdateSymbol(symbol string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.symbols[symbol] = true
+	return nil
+}
+
+func (s *MemoryStore) addOrSetSharesToPosition(accountID string, symbol string, amount decimal.Decimal) error {
+	return s.addSharesToPosition(accountID, symbol, amount)
+}
+
+func (s *MemoryStore) addSharesToPosition(accountID string, symbol string, amount decimal.Decimal) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	positions, ok := s.positions[accountID]
+	if !ok {
+		positions = make(map[string]decimal.Decimal)
+		s.positions[accountID] = positions
+	}
+	positions[symbol] = positions[symbol].Add(amount)
+	return nil
+}
+
+func (s *MemoryStore) getPositionAmount(accountID string, symbol string) (decimal.Decimal, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	amount, ok := s.positions[accountID][symbol]
+	if !ok {
+		return amount, fmt.Errorf("User owns no shares of %s", symbol)
+	}
+	return amount, nil
+}
+
+func (s *MemoryStore) getPositions(accountID string) (map[string]decimal.Decimal, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	positions := make(map[string]decimal.Decimal)
+	for symbol, amount := range s.positions[accountID] {
+		positions[symbol] = amount
+	}
+	return positions, nil
+}
+
+/// Orders
+
+func (s *MemoryStore) createOrder(transID string, acctID string, sym string, limit decimal.Decimal, amount decimal.Decimal, transactionTime time.Time) error {
+	s.mux.Lock()
+	s.orders[transID] = &memoryOrder{info: orderInfo{account: acctID, symbol: sym, limit: limit, amount: amount, origAmount: amount}}
+	s.mux.Unlock()
+
+	s.recordOrderEvent(transID, acctID, sym, eventOpen, amount, limit, amount, transactionTime.String())
+	return nil
+}
+
+func (s *MemoryStore) transactionExists(transID string) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.orders[transID]
+	return ok, nil
+}
+
+func (s *MemoryStore) getOrder(orderID string) (orderInfo, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.orders[orderID]
+	if !ok {
+		return orderInfo{}, fmt.Errorf("Order %s not found", orderID)
+	}
+	return o.info, nil
+}
+
+func (s *MemoryStore) getOrderSeq(orderID string) (uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.orders[orderID]
+	if !ok {
+		return 0, fmt.Errorf("Order %s not found", orderID)
+	}
+	return o.seq, nil
+}
+
+func (s *MemoryStore) getAccountOrders(accountID string) (orders []accountOrder, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for uid, o := range s.orders {
+		if o.info.account != accountID || len(s.events[uid]) == 0 {
+			continue
+		}
+		// as placed, which is its open event
+		placed := s.events[uid][0]
+		orders = append(orders, accountOrder{id: uid, symbol: o.info.symbol, amount: placed.amount, limit: placed.price})
+	}
+	// ids are issued in order
+	sort.Slice(orders, func(i, j int) bool {
+		a, _ := strconv.Atoi(orders[i].id)
+		b, _ := strconv.Atoi(orders[j].id)
+		return a < b
+	})
+	return
+}
+
+// restOrder puts an order created by createOrder into its book.
+func (s *MemoryStore) restOrder(uid string, amount decimal.Decimal, priceLimit decimal.Decimal, reserved decimal.Decimal, seq uint64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.orders[uid]
+	if !ok {
+		return fmt.Errorf("Order %s not found", uid)
+	}
+	o.info.amount, o.info.limit, o.info.reserved, o.seq, o.open = amount, priceLimit, reserved, seq, true
+	return nil
+}
+
+func (s *MemoryStore) createBuyOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, reserved decimal.Decimal, seq uint64) error {
+	return s.restOrder(uid, amount, priceLimit, reserved, seq)
+}
+
+func (s *MemoryStore) createSellOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, seq uint64) error {
+	return s.restOrder(uid, amount, priceLimit, decimal.Zero, seq)
+}
+
+func (s *MemoryStore) updateOrderAmount(uid string, newAmount decimal.Decimal, reserved decimal.Decimal) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.orders[uid]
+	if !ok {
+		return fmt.Errorf("Order %s not found", uid)
+	}
+	o.info.amount, o.info.reserved = newAmount, reserved
+	return nil
+}
+
+func (s *MemoryStore) updateBuyOrderAmount(uid string, newAmount decimal.Decimal, reserved decimal.Decimal) error {
+	return s.updateOrderAmount(uid, newAmount, reserved)
+}
+
+func (s *MemoryStore) updateSellOrderAmount(uid string, newAmount decimal.Decimal) error {
+	return s.updateOrderAmount(uid, newAmount, decimal.Zero)
+}
+
+func (s *MemoryStore) closeOrder(uid string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if o, ok := s.orders[uid]; ok {
+		o.open = false
+	}
+	delete(s.expiries, uid)
+	return nil
+}
+
+func (s *MemoryStore) closeOpenBuyOrder(uid string, sym string) error {
+	return s.closeOrder(uid)
+}
+
+func (s *MemoryStore) closeOpenSellOrder(uid string, sym string) error {
+	return s.closeOrder(uid)
+}
+
+func (s *MemoryStore) getOpenOrders(symbol string, buy bool) (uids []string, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for uid, o := range s.orders {
+		if o.open && o.info.symbol == symbol && (o.info.amount.Sign() > 0) == buy {
+			uids = append(uids, uid)
+		}
+	}
+	return
+}
+
+func (s *MemoryStore) requeueOrder(uid string, symbol string, buy bool, priceLimit decimal.Decimal, seq uint64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	o, ok := s.orders[uid]
+	if !ok {
+		return fmt.Errorf("Order %s not found", uid)
+	}
+	o.info.limit, o.seq, o.open = priceLimit, seq, true
+	return nil
+}
+
+func (s *MemoryStore) cancelOrder(trId string, accountID string, symbol string, amt decimal.Decimal, event string, timestamp string) error {
+	s.recordOrderEvent(trId, accountID, symbol, event, amt, decimal.Zero, decimal.Zero, timestamp)
+	return nil
+}
+
+/// Expiry
+
+func (s *MemoryStore) setOrderExpiry(uid string, buy bool, expires time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.expiries[uid] = expires
+	return nil
+}
+
+func (s *MemoryStore) clearOrderExpiry(uid string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.expiries, uid)
+	return nil
+}
+
+func (s *MemoryStore) getExpiredOrders(now time.Time) (uids []string, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for uid, expires := range s.expiries {
+		if !expires.After(now) {
+			uids = append(uids, uid)
+		}
+	}
+	return
+}
+
+/// Executions and history
+
+func (s *MemoryStore) recordTrade(buyID string, sellID string, buyer string, seller string, symbol string, shares decimal.Decimal, price decimal.Decimal, time string) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.trade++
+	s.executions = append(s.executions, memoryExecution{id: s.trade, buyID: buyID, sellID: sellID, buyer: buyer, seller: seller, symbol: symbol, shares: shares, price: price, time: time})
+	return s.trade, nil
+}
+
+func (s *MemoryStore) recordOrderEvent(orderID string, accountID string, symbol string, event string, amount decimal.Decimal, price decimal.Decimal, remaining decimal.Decimal, time string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.events[orderID] = append(s.events[orderID], orderEvent{event: event, amount: amount, price: price, remaining: remaining, time: time})
+}
+
+func (s *MemoryStore) getOrderEvents(orderID string) ([]orderEvent, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]orderEvent(nil), s.events[orderID]...), nil
+}
+
+/// Administration
+
+// dumpRows lays out what is kept in memory as the Postgres tables would
+// hold it, and returns up to limit rows of one, in key order.
+func (s *MemoryStore) dumpRows(t dumpTable, filter dumpFilter, limit int) (rows [][]string, err error) {
+	s.mux.Lock()
+	var all [][]string
+	switch t.name {
+	case "account":
+		for uid, acct := range s.accounts {
+			all = append(all, []string{uid, acct.balance.String(), acct.reserved.String(), acct.stp})
+		}
+	case "symbol":
+		for symbol := range s.symbols {
+			all = append(all, []string{symbol})
+		}
+	case "position":
+		for acctId, positions := range s.positions {
+			for symbol, amount := range positions {
+				all = append(all, []string{acctId, symbol, amount.String()})
+			}
+		}
+	case "buy_order", "sell_order":
+		for uid, o := range s.orders {
+			if !o.open || (o.info.amount.Sign() > 0) != (t.name == "buy_order") {
+				continue
+			}
+			expires := ""
+			if at, ok := s.expiries[uid]; ok {
+				expires = strconv.FormatInt(at.Unix(), 10)
+			}
+			row := []string{uid, o.info.account, o.info.symbol, o.info.limit.String(), o.info.amount.String()}
+			if t.name == "buy_order" {
+				row = append(row, o.info.reserved.String())
+			}
+			all = append(all, append(row, strconv.FormatUint(o.seq, 10), expires))
+		}
+	case "execution":
+		for _, e := range s.executions {
+			all = append(all, []string{strconv.Itoa(e.id), e.buyID, e.sellID, e.buyer, e.seller, e.symbol, e.shares.String(), e.price.String(), e.time})
+		}
+	}
+	s.mux.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return compareKeys(t.keyOf(all[i]), t.keyOf(all[j])) < 0
+	})
+	for _, row := range all {
+		if len(rows) == limit {
+			break
+		}
+		if filter.after != nil && compareKeys(t.keyOf(row), filter.after) <= 0 {
+			continue
+		}
+		if filter.symbol != "" && row[columnIndex(t, t.symbol)] != filter.symbol {
+			continue
+		}
+		if filter.account != "" {
+			matched := false
+			for _, column := range t.account {
+				matched = matched || row[columnIndex(t, column)] == filter.account
+			}
+			if !matched {
+				continue
+			}
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+func columnIndex(t dumpTable, column string) int {
+	for i, c := range t.columns {
+		if c == column {
+			return i
+		}
+	}
+	return -1
+}
+
+// compareKeys orders keys value by value, numbers as numbers.
+func compareKeys(a []string, b []string) int {
+	for i := range a {
+		if i >= len(b) {
+			return 1
+		}
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		switch {
+		case errX == nil && errY == nil && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		case (errX != nil || errY != nil) && a[i] != b[i]:
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	if len(a) < len(b) {
+		return -1
+	}
+	return 0
+}
@@ -3,28 +3,29 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/farice/EME/decimal"
 	"github.com/farice/EME/redis"
 	redigo "github.com/gomodule/redigo/redis"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
-const user = "postgres"
-const dbname = "exchange"
-const sslmode = "disable"
-const bufferCapacity = 30
-
 // Singleton approach found here: http://marcio.io/2015/07/singleton-pattern-in-go/#comment-2132217074
 var initialized uint32
 var instance *Model
 var mu sync.Mutex
 
+var (
+	queue_mux   sync.Mutex     // keeps the channel in journal order
+	flush_mux   sync.Mutex     // applies batches one flush at a time
+	heldEntries []journalEntry // batches Postgres refused, and every one after them; under flush_mux
+)
+
 func SharedModel() *Model {
 
 	if atomic.LoadUint32(&initialized) == 1 {
@@ -40,14 +41,24 @@ func SharedModel() *Model {
 			log.Fatal("DATABASE ERROR: ", err)
 			return nil
 		}
-		instance = &Model{db, make(chan string, bufferCapacity)}
+		instance = &Model{db: db, commands: make(chan journalEntry, config.BufferCapacity)}
 		atomic.StoreUint32(&initialized, 1)
 	}
 	return instance
 }
 
 func dbInfoString() (info string) {
-	return fmt.Sprintf("user=%s dbname=%s sslmode=%s host=db", user, dbname, sslmode)
+	info = fmt.Sprintf("user=%s dbname=%s sslmode=%s host=%s", quoteDBValue(config.DBUser), quoteDBValue(config.DBName), config.DBSSLMode, quoteDBValue(config.DBHost))
+	if config.DBPassword != "" {
+		info += " password=" + quoteDBValue(config.DBPassword)
+	}
+	return
+}
+
+// quoteDBValue quotes a connection string value so spaces and quotes in it
+// survive.
+func quoteDBValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
 }
 
 // var shared Model = {db, make(chan string, 100)}
@@ -55,11 +66,45 @@ func dbInfoString() (info string) {
 // Model provides access to the application's data layer.
 type Model struct {
 	db       *sql.DB
-	commands chan string
+	commands chan journalEntry
+	journal  *Journal
+	batch    *[]sqlCommand // statements held back for commitBatch, nil for the shared model
+}
+
+// beginBatch returns a model whose statements are held back until
+// commitBatch and then applied to Postgres as one transaction. The caller
+// must hold the locks of everything the batch changes (see locks.go) until
+// commitBatch, so that changes to any one book or balance reach the journal
+// in the order they were made.
+func (m *Model) beginBatch() Store {
+	tx := *m
+	tx.batch = &[]sqlCommand{}
+	return &tx
+}
+
+// commitBatch queues everything submitted since beginBatch as a single entry.
+func (m *Model) commitBatch() {
+	if m.batch == nil || len(*m.batch) == 0 {
+		return
+	}
+	queries := *m.batch
+	*m.batch = nil
+	m.enqueue(queries)
 }
 
 // Counter
 
+// initCounters creates the order and trade id counters if the cache has none.
+func initCounters() {
+	if ex, _ := redis.Exists("TransactionCounter"); !ex {
+		redis.Set("TransactionCounter", 0)
+	}
+	// Trade IDs for executions
+	if ex, _ := redis.Exists("TradeCounter"); !ex {
+		redis.Set("TradeCounter", 0)
+	}
+}
+
 func (m *Model) incTransactionCounter() (ct int, err error) {
 	ct, err = redis.Incr("TransactionCounter")
 	return
@@ -67,7 +112,7 @@ func (m *Model) incTransactionCounter() (ct int, err error) {
 
 /// Accounts
 
-func (m *Model) createAccount(uid string, balance string) (err error) {
+func (m *Model) createAccount(uid string, balance decimal.Decimal, stp string) (err error) {
 	LogMethodTimeElapsed("model.createAccount", time.Now())
 	// This creates a new account with the given unique ID and balance (in USD).
 	// The account has no positions. Attempting to create an account that already
@@ -86,6 +131,12 @@ func (m *Model) createAccount(uid string, balance string) (err error) {
 
 	// Redis HMSET, maps key to hashmap of fields to values
 	err = redis.SetField("acct:"+uid, "balance", balance)
+	if err == nil {
+		err = redis.SetField("acct:"+uid, "reserved", decimal.Zero)
+	}
+	if err == nil && stp != "" {
+		err = redis.SetField("acct:"+uid, "stp", stp)
+	}
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -96,44 +147,57 @@ func (m *Model) createAccount(uid string, balance string) (err error) {
 	}
 
 	// TEST: - Retrieve key + field, then log
-	bal, _ := redis.GetField("acct:"+uid, "balance")
-	bal_float, _ := strconv.ParseFloat(string(bal.([]byte)), 64)
+	bal, _ := m.getAccountBalance(uid)
 	log.WithFields(log.Fields{
 		"ID":             uid,
-		"Balance":        bal_float,
+		"Balance":        bal,
 		"Verify_Balance": balance,
 	}).Info("Created account")
 	// END TEST
 
-	balanceFloat, convErr := strconv.ParseFloat(balance, 64)
-	if convErr != nil {
-		log.Error("Failed conversion of string to float: ", convErr)
-		log.Error("String failed to convert: ", balance)
-	} else {
-		log.Infof("Converted string %s to float %f", balance, balanceFloat)
-	}
 	// postgres. Will reject if duplicate.
-	sqlQuery := fmt.Sprintf(`INSERT INTO account(uid, balance) VALUES('%s', %f)`, uid, bal_float)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`INSERT INTO account(uid, balance, reserved, stp) VALUES($1, $2, 0, $3)`, uid, balance, stp)
 	return
 }
 
-func (m *Model) getAccountBalance(accountID string) (balance float64, err error) {
+// getSelfTradePrevention returns the account's default self-trade
+// prevention mode, "" if it has none.
+func (m *Model) getSelfTradePrevention(accountID string) (stp string, err error) {
+	defer LogMethodTimeElapsed("model.getSelfTradePrevention", time.Now())
+	if ex, _ := redis.HExists("acct:"+accountID, "balance"); ex {
+		var data interface{}
+		data, err = redis.GetField("acct:"+accountID, "stp")
+		if data != nil && err == nil {
+			stp, err = redigo.String(data, nil)
+		}
+		return
+	}
+
+	sqlQuery := `SELECT stp FROM account WHERE uid=$1`
+	err = m.db.QueryRow(sqlQuery, accountID).Scan(&stp)
+	if err != nil {
+		log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
+		err = fmt.Errorf("Account does not exist")
+	}
+	return
+}
+
+func (m *Model) getAccountBalance(accountID string) (balance decimal.Decimal, err error) {
 	LogMethodTimeElapsed("model.getAccountBalance", time.Now())
 	// Attempt fetch from redis
 	log.Info("Get account balance.")
 	bal, err := redis.GetField("acct:"+accountID, "balance")
 	if bal != nil && err == nil {
-		balance, err = strconv.ParseFloat(string(bal.([]byte)), 64)
+		err = balance.RedisScan(bal)
 		log.WithFields(log.Fields{
 			"balance": balance,
 		}).Info("Got balance")
-		return balance, nil
+		return balance, err
 	}
 
 	// If must check postgres
-	sqlQuery := fmt.Sprintf(`SELECT balance FROM account WHERE uid='%s'`, accountID)
-	err = m.db.QueryRow(sqlQuery).Scan(&balance)
+	sqlQuery := `SELECT balance FROM account WHERE uid=$1`
+	err = m.db.QueryRow(sqlQuery, accountID).Scan(&balance)
 	if err != nil {
 		log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
 		err = fmt.Errorf("Account does not exist")
@@ -142,32 +206,117 @@ func (m *Model) getAccountBalance(accountID string) (balance float64, err error)
 	return balance, nil
 }
 
-func (m *Model) addAccountBalance(accountID string, amount float64) (err error) {
-	defer LogMethodTimeElapsed("model.addAccountBalance", time.Now())
+// getAccountFunds returns an account's cash and how much of it resting buy
+// orders have reserved. The rest is available to new orders.
+func (m *Model) getAccountFunds(accountID string) (balance decimal.Decimal, reserved decimal.Decimal, err error) {
+	defer LogMethodTimeElapsed("model.getAccountFunds", time.Now())
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	// both fields in one read, so a fill settling concurrently is seen whole
+	values, err := redigo.Values(conn.Do("HMGET", "acct:"+accountID, "balance", "reserved"))
+	if err == nil && values[0] != nil {
+		err = balance.RedisScan(values[0])
+		if err == nil && values[1] != nil {
+			err = reserved.RedisScan(values[1])
+		}
+		return
+	}
+
+	sqlQuery := `SELECT balance, reserved FROM account WHERE uid=$1`
+	err = m.db.QueryRow(sqlQuery, accountID).Scan(&balance, &reserved)
+	if err != nil {
+		log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
+		err = fmt.Errorf("Account does not exist")
+	}
+	return
+}
+
+// cacheAccount loads an account into the cache if it isn't there, so that
+// changes can be applied to it as increments.
+func (m *Model) cacheAccount(accountID string) (err error) {
 	ex, _ := redis.HExists("acct:"+accountID, "balance")
-	if ex == false {
-		// If not in cache
-		var newBalance float64
-		sqlQuery := fmt.Sprintf(`UPDATE account SET balance=balance+%f WHERE uid='%s' RETURNING balance`, amount, accountID)
-		err = m.db.QueryRow(sqlQuery).Scan(&newBalance)
-		if err != nil {
-			// Likely non-existent account
+	if ex {
+		return
+	}
+	var balance, reserved decimal.Decimal
+	var stp string
+	sqlQuery := `SELECT balance, reserved, stp FROM account WHERE uid=$1`
+	err = m.db.QueryRow(sqlQuery, accountID).Scan(&balance, &reserved, &stp)
+	if err != nil {
+		if err != sql.ErrNoRows {
 			log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
-			err = fmt.Errorf("Account does not exist")
+		}
+		return fmt.Errorf("Account does not exist")
+	}
+	// a concurrent credit may have loaded it first, so only fill a gap
+	if stp != "" {
+		if _, err = redis.SetFieldNX("acct:"+accountID, "stp", stp); err != nil {
 			return
 		}
-		err = redis.SetField("acct:"+accountID, "balance", newBalance)
+	}
+	if _, err = redis.SetFieldNX("acct:"+accountID, "reserved", reserved); err != nil {
 		return
 	}
-	redis.HIncrByFloat("acct:"+accountID, "balance", amount)
+	_, err = redis.SetFieldNX("acct:"+accountID, "balance", balance)
+	return
+}
 
-	var newBalance float64
-	sqlQuery := fmt.Sprintf(`UPDATE account SET balance=balance+%f WHERE uid='%s' RETURNING balance`, amount, accountID)
-	sqlErr := m.db.QueryRow(sqlQuery).Scan(&newBalance)
-	if sqlErr != nil {
-		log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
+// reserveFunds sets amount aside for a buy order, failing if the account
+// doesn't have that much available. The caller must hold the account's
+// lock; anything else can only make more available in the meantime.
+func (m *Model) reserveFunds(accountID string, amount decimal.Decimal) (err error) {
+	defer LogMethodTimeElapsed("model.reserveFunds", time.Now())
+	if err = m.cacheAccount(accountID); err != nil {
+		return
+	}
+	balance, reserved, err := m.getAccountFunds(accountID)
+	if err != nil {
+		return
+	}
+	if amount.Cmp(balance.Sub(reserved)) > 0 {
+		return fmt.Errorf("Insufficient funds")
+	}
+	if _, err = redis.HIncrBy("acct:"+accountID, "reserved", amount.Units()); err != nil {
+		return
+	}
+	m.submitQuery(`UPDATE account SET reserved=reserved+$1 WHERE uid=$2`, amount, accountID)
+	return
+}
+
+// releaseFunds takes released out of an account's reservation and spent out
+// of its balance in one step, as when a resting buy fills (spent is what the
+// shares cost, released what the order had reserved for them) or is
+// canceled (spent is zero).
+func (m *Model) releaseFunds(accountID string, released decimal.Decimal, spent decimal.Decimal) (err error) {
+	defer LogMethodTimeElapsed("model.releaseFunds", time.Now())
+	if err = m.cacheAccount(accountID); err != nil {
+		return
+	}
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", "acct:"+accountID, "reserved", released.Neg().Units())
+	conn.Send("HINCRBY", "acct:"+accountID, "balance", spent.Neg().Units())
+	if _, err = conn.Do("EXEC"); err != nil {
+		return
+	}
+	m.submitQuery(`UPDATE account SET balance=balance-$1, reserved=reserved-$2 WHERE uid=$3`, spent, released, accountID)
+	return
+}
+
+func (m *Model) addAccountBalance(accountID string, amount decimal.Decimal) (err error) {
+	defer LogMethodTimeElapsed("model.addAccountBalance", time.Now())
+	if err = m.cacheAccount(accountID); err != nil {
+		return
+	}
+	if _, err = redis.HIncrBy("acct:"+accountID, "balance", amount.Units()); err != nil {
+		return
 	}
 
+	// queued with the rest of the request, so it commits or fails with them
+	m.submitQuery(`UPDATE account SET balance=balance+$1 WHERE uid=$2`, amount, accountID)
 	return
 }
 
@@ -175,103 +324,215 @@ func (m *Model) accountExists(accountID string) (ex bool, err error) {
 	defer LogMethodTimeElapsed("model.accountExists", time.Now())
 	log.Info("Account Exists")
 	ex, err = redis.Exists("acct:" + accountID)
-	if !ex {
-		sqlQuery := fmt.Sprintf(`SELECT * FROM account WHERE uid='%s'`, accountID)
-		var balance float64
-		sqlErr := m.db.QueryRow(sqlQuery).Scan(&balance)
-		if sqlErr == nil {
-			// Exists in DB
-			bal_string := strconv.FormatFloat(balance, 'E', -1, 64)
-			err = redis.SetField("acct:"+accountID, "balance", bal_string)
-			return true, nil
-		}
+	if err != nil || ex {
+		return
+	}
+	// not cached: load all of it, as createAccount would have cached it
+	if m.cacheAccount(accountID) == nil {
+		return true, nil
 	}
-
 	return
 }
 
 /// Open orders
 
-func (m *Model) createBuyOrder(uid string, accountID string, symbol string, amount float64, limit_str string, priceLimit float64) (err error) {
+func (m *Model) createBuyOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, reserved decimal.Decimal, seq uint64) (err error) {
 	defer LogMethodTimeElapsed("model.createBuyOrder", time.Now())
 	log.Info("Create Buy Order")
 
-	err = redis.Zadd("open-buy:"+symbol, limit_str, uid)
+	err = redis.Zadd("open-buy:"+symbol, priceLimit.Units(), uid)
+	if err != nil {
+		return
+	}
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HMSET", "order:"+uid, "seq", seq, "reserved", reserved)
 
-	sqlQuery := fmt.Sprintf(`INSERT INTO buy_order(uid, account_id, symbol, amount, price_limit) VALUES('%s', '%s', '%s', %f, %f);`, uid, accountID, symbol, amount, priceLimit)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`INSERT INTO buy_order(uid, account_id, symbol, amount, price_limit, reserved, seq) VALUES($1, $2, $3, $4, $5, $6, $7)`, uid, accountID, symbol, amount, priceLimit, reserved, seq)
 	return err
 }
 
-func (m *Model) updateBuyOrderAmount(uid string, newAmount float64) (err error) {
+func (m *Model) updateBuyOrderAmount(uid string, newAmount decimal.Decimal, reserved decimal.Decimal) (err error) {
 	defer LogMethodTimeElapsed("model.updateBuyOrderAmount", time.Now())
 
-	err = redis.SetField("order:"+uid, "amount", newAmount)
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HMSET", "order:"+uid, "amount", newAmount, "reserved", reserved)
 
-	sqlQuery := fmt.Sprintf(`UPDATE buy_order SET amount=%f WHERE uid = '%s'`, newAmount, uid)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`UPDATE buy_order SET amount=$1, reserved=$2 WHERE uid = $3`, newAmount, reserved, uid)
 	return
 }
 
-// fills cancellation details
-func (m *Model) cancelOrder(trId string, amt_f float64, timestamp string) (err error) {
+// fills cancellation details; event is eventCancel, or eventSelfTrade when
+// the order was canceled to keep it from trading with its own account
+func (m *Model) cancelOrder(trId string, accountID string, symbol string, amt decimal.Decimal, event string, timestamp string) (err error) {
 	defer LogMethodTimeElapsed("model.cancelOrder", time.Now())
 	log.Info("Cancel Order")
-	conn := redis.Pool.Get()
-	defer conn.Close()
-	_, err = conn.Do("HMSET", "order-cancel:"+trId, "amount", amt_f, "time", timestamp)
 
 	// Postgres removes the open order
-	var sqlQuery string
-	if amt_f > 0 {
-		sqlQuery = fmt.Sprintf(`DELETE FROM buy_order WHERE uid='%s'`, trId)
+	if amt.Sign() > 0 {
+		m.submitQuery(`DELETE FROM buy_order WHERE uid=$1`, trId)
 	} else {
-		sqlQuery = fmt.Sprintf(`DELETE FROM sell_order WHERE uid='%s'`, trId)
+		m.submitQuery(`DELETE FROM sell_order WHERE uid=$1`, trId)
 	}
-	m.submitQuery(sqlQuery)
 
+	m.recordOrderEvent(trId, accountID, symbol, event, amt, decimal.Zero, decimal.Zero, timestamp)
 	return
 }
 
-// is order cancelled
-func (m *Model) orderCancelled(trId string) (ex bool, err error) {
-	ex, err = redis.Exists("order-cancel:" + trId)
-	// TODO - postgres
+/// Order lifecycle
 
-	return
-}
+// Events recorded against an order in order_event
+const (
+	eventOpen      = "open"      // accepted: amount is the order size, price its limit
+	eventPartial   = "partial"   // traded part: amount traded at price, remaining left
+	eventFill      = "fill"      // traded the rest: amount traded at price
+	eventCancel    = "cancel"    // amount was canceled
+	eventSelfTrade = "selftrade" // amount was canceled rather than trade with the same account, remaining left
+	eventReplace   = "replace"   // amended to remaining at limit price
+)
 
-func (m *Model) getCancelledOrderDetails(trId string) (cancel_info []string, err error) {
-	conn := redis.Pool.Get()
-	defer conn.Close()
+// An entry in an order's history. amount and remaining are negative for sells.
+type orderEvent struct {
+	event     string
+	amount    decimal.Decimal
+	price     decimal.Decimal
+	remaining decimal.Decimal
+	time      string
+}
 
-	cancel_info, err = redigo.Strings(conn.Do("HMGET", "order-cancel:"+trId, "amount", "time"))
+// An order's history is kept in the cache as well, as the list
+// order-events:<id>, so it can be read back in the middle of a request,
+// before the request's batch has reached Postgres. An order the cache has no
+// list for has not changed since the cache was lost, so its whole history is
+// in Postgres (the journal is replayed before anything else runs); it is
+// copied into the cache before anything is added to it.
+func (m *Model) recordOrderEvent(orderID string, accountID string, symbol string, event string, amount decimal.Decimal, price decimal.Decimal, remaining decimal.Decimal, time string) {
+	if event != eventOpen {
+		m.cacheOrderEvents(orderID)
+	}
+	e := orderEvent{event: event, amount: amount, price: price, remaining: remaining, time: time}
+	if err := pushCached("order-events:"+orderID, encodeOrderEvent(e)); err != nil {
+		log.WithFields(log.Fields{
+			"orderID": orderID,
+			"error":   err,
+		}).Error("Failed to cache order event")
+	}
+	m.submitQuery(`INSERT INTO order_event(order_id, account_id, symbol, event, amount, price, remaining, event_time) VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+		orderID, accountID, symbol, event, amount, price, remaining, time)
+}
 
-	// TODO - postgres
+// cacheOrderEvents copies an order's history from Postgres into the cache,
+// unless the cache already has it.
+func (m *Model) cacheOrderEvents(orderID string) {
+	if ex, _ := redis.Exists("order-events:" + orderID); ex {
+		return
+	}
+	events, err := m.storedOrderEvents(orderID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"orderID": orderID,
+			"error":   err,
+		}).Error("Failed to load order history")
+		return
+	}
+	encoded := make([]string, len(events))
+	for i, e := range events {
+		encoded[i] = encodeOrderEvent(e)
+	}
+	pushCached("order-events:"+orderID, encoded...)
+}
 
+// getOrderEvents reads an order's history, oldest first, including whatever
+// the request has recorded so far.
+func (m *Model) getOrderEvents(orderID string) (events []orderEvent, err error) {
+	defer LogMethodTimeElapsed("model.getOrderEvents", time.Now())
+	cached, err := rangeCached("order-events:" + orderID)
+	if err != nil {
+		return
+	}
+	if len(cached) == 0 {
+		return m.storedOrderEvents(orderID)
+	}
+	for _, c := range cached {
+		var e orderEvent
+		if e, err = decodeOrderEvent(c); err != nil {
+			return
+		}
+		events = append(events, e)
+	}
 	return
 }
 
-// Update Executed shares list
-func (m *Model) executedOrder(trId string, amount float64, limit float64, time string) (err error) {
-	conn := redis.Pool.Get()
-	defer conn.Close()
+// storedOrderEvents reads an order's history from Postgres, oldest first.
+func (m *Model) storedOrderEvents(orderID string) (events []orderEvent, err error) {
+	rows, err := m.db.Query(`SELECT event, amount, price, remaining, event_time FROM order_event WHERE order_id=$1 ORDER BY event_id`, orderID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e orderEvent
+		if err = rows.Scan(&e.event, &e.amount, &e.price, &e.remaining, &e.time); err != nil {
+			return
+		}
+		events = append(events, e)
+	}
+	err = rows.Err()
+	return
+}
 
-	_, err = conn.Do("RPUSH", "order-executed:"+trId, amount, limit, time)
-	// TODO - postgres
+// An event is cached as event|amount|price|remaining|time, the numbers in
+// units as everywhere else in Redis.
+func encodeOrderEvent(e orderEvent) string {
+	return fmt.Sprintf("%s|%d|%d|%d|%s", e.event, e.amount.Units(), e.price.Units(), e.remaining.Units(), e.time)
+}
 
+func decodeOrderEvent(cached string) (e orderEvent, err error) {
+	fields := strings.SplitN(cached, "|", 5)
+	if len(fields) != 5 {
+		err = fmt.Errorf("Malformed cached order event %q", cached)
+		return
+	}
+	e.event, e.time = fields[0], fields[4]
+	if e.amount, err = decimal.ParseUnits(fields[1]); err != nil {
+		return
+	}
+	if e.price, err = decimal.ParseUnits(fields[2]); err != nil {
+		return
+	}
+	e.remaining, err = decimal.ParseUnits(fields[3])
 	return
 }
 
-// from list constructed directly above
-func getPartialExecutions(trId string) (transactions []string, err error) {
+// pushCached appends values to the list at key.
+func pushCached(key string, values ...string) (err error) {
+	if len(values) == 0 {
+		return
+	}
 	conn := redis.Pool.Get()
 	defer conn.Close()
+	args := redigo.Args{}.Add(key).AddFlat(values)
+	_, err = conn.Do("RPUSH", args...)
+	return
+}
 
-	transactions, err = redigo.Strings(conn.Do("LRANGE", "order-executed:"+trId, 0, -1))
-
-	// TODO = postgres
+// rangeCached returns the whole list at key, empty if there is none.
+func rangeCached(key string) ([]string, error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	return redigo.Strings(conn.Do("LRANGE", key, 0, -1))
+}
 
+// recordTrade stores one fill between a buy and a sell order as an
+// execution row, under a new trade id.
+func (m *Model) recordTrade(buyID string, sellID string, buyer string, seller string, symbol string, shares decimal.Decimal, price decimal.Decimal, time string) (tradeID int, err error) {
+	tradeID, err = redis.Incr("TradeCounter")
+	if err != nil {
+		return
+	}
+	m.submitQuery(`INSERT INTO execution(trade_id, buy_order_id, sell_order_id, buyer_id, seller_id, symbol, amount, price, executed_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		tradeID, buyID, sellID, buyer, seller, symbol, shares, price, time)
 	return
 }
 
@@ -283,6 +544,8 @@ func (m *Model) closeOpenBuyOrder(uid string, sym string) (err error) {
 	// num deleted
 	var num int
 	num, err = redigo.Int(conn.Do("ZREM", "open-buy:"+sym, uid))
+	// a closed order has nothing left to expire
+	conn.Do("ZREM", "order-expiry", uid)
 
 	log.WithFields(log.Fields{
 		"transId": uid,
@@ -291,8 +554,7 @@ func (m *Model) closeOpenBuyOrder(uid string, sym string) (err error) {
 	}).Info("Removed open order from sorted set")
 
 	// If have to go to db
-	sqlQuery := fmt.Sprintf(`DELETE FROM buy_order WHERE uid='%s'`, uid)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`DELETE FROM buy_order WHERE uid=$1`, uid)
 	// sqlErr := m.db.QueryRow(sqlQuery).Scan()
 	// if sqlErr != nil {
 	// 	log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
@@ -300,21 +562,23 @@ func (m *Model) closeOpenBuyOrder(uid string, sym string) (err error) {
 	return
 }
 
-func (m *Model) createSellOrder(uid string, accountID string, symbol string, amount float64, limit_str string, priceLimit float64) (err error) {
+func (m *Model) createSellOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, seq uint64) (err error) {
 	defer LogMethodTimeElapsed("model.createSellOrder", time.Now())
-	err = redis.Zadd("open-sell:"+symbol, limit_str, uid)
+	err = redis.Zadd("open-sell:"+symbol, priceLimit.Units(), uid)
+	if err != nil {
+		return
+	}
+	err = redis.SetField("order:"+uid, "seq", seq)
 
-	sqlQuery := fmt.Sprintf(`INSERT INTO sell_order(uid, account_id, symbol, amount, price_limit) VALUES('%s', '%s', '%s', %f, %f);`, uid, accountID, symbol, amount, priceLimit)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`INSERT INTO sell_order(uid, account_id, symbol, amount, price_limit, seq) VALUES($1, $2, $3, $4, $5, $6)`, uid, accountID, symbol, amount, priceLimit, seq)
 	return err
 }
 
-func (m *Model) updateSellOrderAmount(uid string, newAmount float64) (err error) {
+func (m *Model) updateSellOrderAmount(uid string, newAmount decimal.Decimal) (err error) {
 	defer LogMethodTimeElapsed("model.updateSellOrderAmount", time.Now())
 	err = redis.SetField("order:"+uid, "amount", newAmount)
 
-	sqlQuery := fmt.Sprintf(`UPDATE sell_order SET amount=%f WHERE uid = '%s'`, newAmount, uid)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`UPDATE sell_order SET amount=$1 WHERE uid = $2`, newAmount, uid)
 	return
 }
 
@@ -326,6 +590,8 @@ func (m *Model) closeOpenSellOrder(uid string, sym string) (err error) {
 	// num deleted
 	var num int
 	num, err = redigo.Int(conn.Do("ZREM", "open-sell:"+sym, uid))
+	// a closed order has nothing left to expire
+	conn.Do("ZREM", "order-expiry", uid)
 
 	log.WithFields(log.Fields{
 		"transId": uid,
@@ -334,8 +600,7 @@ func (m *Model) closeOpenSellOrder(uid string, sym string) (err error) {
 	}).Info("Removed open order from sorted set")
 
 	// If must go to db
-	sqlQuery := fmt.Sprintf(`DELETE FROM sell_order WHERE uid='%s'`, uid)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`DELETE FROM sell_order WHERE uid=$1`, uid)
 	// sqlErr := m.db.QueryRow(sqlQuery).Scan()
 	// if sqlErr != nil {
 	// 	log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
@@ -343,43 +608,65 @@ func (m *Model) closeOpenSellOrder(uid string, sym string) (err error) {
 	return
 }
 
-func (m *Model) getMaximumBuyOrder(symbol string, priceLimit float64) (uid []string, err error) {
-	defer LogMethodTimeElapsed("model.getMaximumBuyOrder", time.Now())
-	uid, err = redis.Zrange("open-buy:"+symbol, -1, -1, true)
-	if len(uid) > 0 && uid[0] != "" {
+// All open orders for symbol on one side of the book, lowest limit first
+func (m *Model) getOpenOrders(symbol string, buy bool) (uids []string, err error) {
+	defer LogMethodTimeElapsed("model.getOpenOrders", time.Now())
+	if buy {
+		uids, err = redis.Zrange("open-buy:"+symbol, 0, -1, false)
+	} else {
+		uids, err = redis.Zrange("open-sell:"+symbol, 0, -1, false)
+	}
+	return
+}
+
+// Move a resting order to a new limit and/or the back of its price level
+func (m *Model) requeueOrder(uid string, symbol string, buy bool, priceLimit decimal.Decimal, seq uint64) (err error) {
+	defer LogMethodTimeElapsed("model.requeueOrder", time.Now())
+	set, table := "open-sell:", "sell_order"
+	if buy {
+		set, table = "open-buy:", "buy_order"
+	}
+
+	err = redis.Zadd(set+symbol, priceLimit.Units(), uid)
+	if err != nil {
 		return
 	}
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("HMSET", "order:"+uid, "limit", priceLimit, "seq", seq)
 
-	// TODO - Fix syntax error
-	/*
-		sqlQuery := fmt.Sprintf(`SELECT TOP 1 uid FROM buy_order WHERE price_limit=(SELECT MAX(price_limit) FROM buy_order WHERE symbol=%s)  AND price_limit >= %f`, symbol, priceLimit)
-		err = m.db.QueryRow(sqlQuery).Scan(&uid)
-		if err != nil {
-			log.Error("SQL Error: %s -- Query: %s", err, sqlQuery)
-			return
-		}
-	*/
+	// table is one of our own names, never client input
+	m.submitQuery(`UPDATE `+table+` SET price_limit=$1, seq=$2 WHERE uid=$3`, priceLimit, seq, uid)
 	return
-
 }
 
-func (m *Model) getMinimumSellOrder(symbol string, priceLimit float64) (uid []string, err error) {
-	defer LogMethodTimeElapsed("model.getMinimumSellOrder", time.Now())
-	log.Info("Get minimum sell order")
-	uid, err = redis.Zrange("open-sell:"+symbol, 0, 0, true)
-	if len(uid) > 0 && uid[0] != "" {
-		return
+/// Order expiry
+
+// Schedule a resting GTD order to be canceled at expires
+func (m *Model) setOrderExpiry(uid string, buy bool, expires time.Time) (err error) {
+	defer LogMethodTimeElapsed("model.setOrderExpiry", time.Now())
+	err = redis.Zadd("order-expiry", expires.Unix(), uid)
+
+	table := "sell_order"
+	if buy {
+		table = "buy_order"
 	}
+	m.submitQuery(`UPDATE `+table+` SET expires_at=$1 WHERE uid=$2`, expires.Unix(), uid)
+	return
+}
 
-	// TODO - Fix syntax error
-	/*
-		// If must go to db
-		sqlQuery := fmt.Sprintf(`SELECT TOP 1 uid FROM sell_order WHERE price_limit=(SELECT MIN(price_limit) FROM sell_order WHERE symbol=%s)  AND price_limit <= %f`, symbol, priceLimit)
-		err = m.db.QueryRow(sqlQuery).Scan(&uid)
-		if err != nil {
-			log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, sqlQuery))
-			return
-		} */
+func (m *Model) clearOrderExpiry(uid string) (err error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("ZREM", "order-expiry", uid)
+	return
+}
+
+// GTD orders whose expiry is at or before now
+func (m *Model) getExpiredOrders(now time.Time) (uids []string, err error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	uids, err = redigo.Strings(conn.Do("ZRANGEBYSCORE", "order-expiry", "-inf", now.Unix()))
 	return
 }
 
@@ -389,18 +676,22 @@ func (m *Model) transactionExists(transID string) (ex bool, err error) {
 	ex, err = redis.Exists("order:" + transID)
 
 	if !ex {
-		sqlQuery := fmt.Sprintf(`SELECT * FROM sell_order WHERE uid='%s'`, transID)
-		sqlErr := m.db.QueryRow(sqlQuery).Scan()
+		var uid string
+		sqlErr := m.db.QueryRow(`SELECT uid FROM sell_order WHERE uid=$1`, transID).Scan(&uid)
+		if sqlErr == nil {
+			return true, nil
+		}
+		sqlErr = m.db.QueryRow(`SELECT uid FROM buy_order WHERE uid=$1`, transID).Scan(&uid)
 		if sqlErr == nil {
 			return true, nil
 		}
-		sqlQuery = fmt.Sprintf(`SELECT * FROM buy_order WHERE uid='%s'`, transID)
-		sqlErr = m.db.QueryRow(sqlQuery).Scan()
+		var tradeID int64
+		sqlErr = m.db.QueryRow(`SELECT trade_id FROM execution WHERE buy_order_id=$1 OR sell_order_id=$1 LIMIT 1`, transID).Scan(&tradeID)
 		if sqlErr == nil {
 			return true, nil
 		}
-		sqlQuery = fmt.Sprintf(`SELECT * FROM transaction WHERE uid='%s'`, transID)
-		sqlErr = m.db.QueryRow(sqlQuery).Scan()
+		// canceled or killed without trading, it is left only in its history
+		sqlErr = m.db.QueryRow(`SELECT order_id FROM order_event WHERE order_id=$1 LIMIT 1`, transID).Scan(&uid)
 		if sqlErr == nil {
 			return true, nil
 		}
@@ -409,91 +700,150 @@ func (m *Model) transactionExists(transID string) (ex bool, err error) {
 	return
 }
 
-func (m *Model) createOrder(transID string, acctID string, sym string, limit string, amount string, transactionTime time.Time) (err error) {
+func (m *Model) createOrder(transID string, acctID string, sym string, limit decimal.Decimal, amount decimal.Decimal, transactionTime time.Time) (err error) {
 	log.Info("mode.createOrder")
 	LogMethodTimeElapsed("mode.createOrder", time.Now())
 	conn := redis.Pool.Get()
 	defer conn.Close()
 	_, err = conn.Do("HMSET", "order:"+transID, "account", acctID, "symbol", sym, "limit", limit, "amount", amount, "origAmount", amount)
+	if err != nil {
+		return
+	}
 
-	// No need to create anything in postgres here.
+	// the order table only holds what rests, so record that it was placed
+	m.recordOrderEvent(transID, acctID, sym, eventOpen, amount, limit, amount, transactionTime.String())
+	m.cacheAccountOrders(acctID)
+	err = pushCached("acct-orders:"+acctID, encodeAccountOrder(accountOrder{id: transID, symbol: sym, amount: amount, limit: limit}))
 
-	// amountFloat, _ := strconv.ParseFloat(amount, 64)
-	// limitFloat, _ := strconv.ParseFloat(limit, 64)
+	return
+}
 
-	// formattedTime := transactionTime.String()
+// The cached record of an order, open or closed
+type orderInfo struct {
+	account    string
+	symbol     string
+	limit      decimal.Decimal
+	amount     decimal.Decimal // remaining, negative for sells
+	origAmount decimal.Decimal
+	reserved   decimal.Decimal // cash a buy still holds for what remains
+}
 
-	// sqlQuery := fmt.Sprintf(`INSERT INTO transaction(uid, symbol, amount, price, transaction_time) VALUES('%s', '%s', %f, %f, '%s')`, transID, sym, amountFloat, limitFloat, formattedTime)
-	// m.submitQuery(sqlQuery)
+// An order as it was placed, for listing an account's orders
+type accountOrder struct {
+	id     string
+	symbol string
+	amount decimal.Decimal // negative for sells
+	limit  decimal.Decimal // zero for market orders
+}
 
+// getAccountOrders lists every order the account has placed, oldest first,
+// including any the request has placed so far. The cache keeps the list as
+// acct-orders:<id>, filled from Postgres as an order's history is.
+func (m *Model) getAccountOrders(accountID string) (orders []accountOrder, err error) {
+	defer LogMethodTimeElapsed("model.getAccountOrders", time.Now())
+	cached, err := rangeCached("acct-orders:" + accountID)
+	if err != nil {
+		return
+	}
+	if len(cached) == 0 {
+		return m.storedAccountOrders(accountID)
+	}
+	for _, c := range cached {
+		var o accountOrder
+		if o, err = decodeAccountOrder(c); err != nil {
+			return
+		}
+		orders = append(orders, o)
+	}
+	return
+}
+
+// cacheAccountOrders copies the account's orders from Postgres into the
+// cache, unless the cache already has them.
+func (m *Model) cacheAccountOrders(accountID string) {
+	if ex, _ := redis.Exists("acct-orders:" + accountID); ex {
+		return
+	}
+	orders, err := m.storedAccountOrders(accountID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"accountID": accountID,
+			"error":     err,
+		}).Error("Failed to load account orders")
+		return
+	}
+	encoded := make([]string, len(orders))
+	for i, o := range orders {
+		encoded[i] = encodeAccountOrder(o)
+	}
+	pushCached("acct-orders:"+accountID, encoded...)
+}
+
+// storedAccountOrders reads the account's orders from the open events in
+// Postgres, oldest first.
+func (m *Model) storedAccountOrders(accountID string) (orders []accountOrder, err error) {
+	rows, err := m.db.Query(`SELECT order_id, symbol, amount, price FROM order_event WHERE account_id=$1 AND event=$2 ORDER BY event_id`, accountID, eventOpen)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o accountOrder
+		if err = rows.Scan(&o.id, &o.symbol, &o.amount, &o.limit); err != nil {
+			return
+		}
+		orders = append(orders, o)
+	}
+	err = rows.Err()
+	return
+}
+
+// An account's order is cached as id|symbol|amount|limit.
+func encodeAccountOrder(o accountOrder) string {
+	return fmt.Sprintf("%s|%s|%d|%d", o.id, o.symbol, o.amount.Units(), o.limit.Units())
+}
+
+func decodeAccountOrder(cached string) (o accountOrder, err error) {
+	fields := strings.Split(cached, "|")
+	if len(fields) != 4 {
+		err = fmt.Errorf("Malformed cached order %q", cached)
+		return
+	}
+	o.id, o.symbol = fields[0], fields[1]
+	if o.amount, err = decimal.ParseUnits(fields[2]); err != nil {
+		return
+	}
+	o.limit, err = decimal.ParseUnits(fields[3])
 	return
 }
 
 // Get order or closed transaction.
-func (m *Model) getOrder(orderID string) (data []string, err error) {
+func (m *Model) getOrder(orderID string) (order orderInfo, err error) {
 	defer LogMethodTimeElapsed("model.getOrder", time.Now())
 	conn := redis.Pool.Get()
 	defer conn.Close()
-	data, err = redigo.Strings(conn.Do("HMGET", "order:"+orderID, "account", "symbol", "limit", "amount", "origAmount"))
-
-	/*
-
-	// postgres
-	var uid string
-	var accountID string
-	var symbol string
-	limit := 0.0
-	var amount float64
-	// originalAmount := 0.0
-	var time string
-
-	sqlQuery := fmt.Sprintf(`SELECT * FROM sell_order WHERE uid='%s'`, orderID)
-	sqlErr := m.db.QueryRow(sqlQuery).Scan(&uid, &accountID, &symbol, &limit, &amount)
-	if sqlErr == nil {
-		limitString := strconv.FormatFloat(limit, 'E', -1, 64)
-		amountString := strconv.FormatFloat(amount, 'E', -1, 64)
-		// "account", "symbol", "limit", "amount", "origAmount"
-		data = []string{
-			accountID,
-			symbol,
-			limitString,
-			// TODO - Confirm that this is remaining amount
-			amountString,
-			// TODO - Need to retrieve original amount
-			amountString,
-		}
-		return data, err
-	}
-	sqlQuery = fmt.Sprintf(`SELECT * FROM buy_order WHERE uid='%s'`, orderID)
-	sqlErr = m.db.QueryRow(sqlQuery).Scan(&uid, &accountID, &symbol, &limit, &amount)
-	if sqlErr == nil {
-		limitString := strconv.FormatFloat(limit, 'E', -1, 64)
-		amountString := strconv.FormatFloat(amount, 'E', -1, 64)
-		data = []string{
-			uid,
-			accountID,
-			symbol,
-			limitString,
-			amountString,
-		}
-		return data, err
-	}
-	sqlQuery = fmt.Sprintf(`SELECT * FROM transaction WHERE uid='%s'`, orderID)
-	sqlErr = m.db.QueryRow(sqlQuery).Scan(&uid, &symbol, &amount, &limit, &time)
-	if sqlErr == nil {
-		limitString := strconv.FormatFloat(limit, 'E', -1, 64)
-		amountString := strconv.FormatFloat(amount, 'E', -1, 64)
-		data = []string{
-			uid,
-			accountID,
-			symbol,
-			limitString,
-			amountString,
-		}
-		return data, err
+	data, err := redigo.Values(conn.Do("HMGET", "order:"+orderID, "account", "symbol", "limit", "amount", "origAmount", "reserved"))
+	if err != nil {
+		return
+	}
+	if data[0] == nil {
+		err = fmt.Errorf("Order %s not found", orderID)
+		return
 	}
-	*/
+	_, err = redigo.Scan(data, &order.account, &order.symbol, &order.limit, &order.amount, &order.origAmount, &order.reserved)
+	if err == nil && data[5] == nil && order.amount.Sign() > 0 {
+		// cached before buys kept their reservation, which was then
+		// always the full remainder at the limit
+		order.reserved = order.amount.Mul(order.limit)
+	}
+	return
+}
 
+// Arrival sequence of a resting order within its book
+func (m *Model) getOrderSeq(orderID string) (seq uint64, err error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	seq, err = redigo.Uint64(conn.Do("HGET", "order:"+orderID, "seq"))
 	return
 }
 
@@ -504,75 +854,61 @@ func (m *Model) createOrUpdateSymbol(symbol string) (err error) {
 	ex, _ := redis.Exists("sym:" + symbol)
 	if !ex {
 		redis.Set("sym:"+symbol, "")
-		sqlQuery := fmt.Sprintf(`INSERT INTO symbol(name) VALUES('%s');`, symbol)
-		m.submitQuery(sqlQuery)
+		m.submitQuery(`INSERT INTO symbol(name) VALUES($1)`, symbol)
 	}
 	return
 }
 
 /// Positions
 
-// Add shares to existing position or set shares to value if dne
-func (m *Model) addOrSetSharesToPosition(accountID string, symbol string, amount float64) (err error) {
+// Add shares to a position, creating it if there is none. Both the cache
+// and Postgres are only incremented, so a trade may credit the resting
+// account without holding its lock.
+func (m *Model) addOrSetSharesToPosition(accountID string, symbol string, amount decimal.Decimal) (err error) {
 	defer LogMethodTimeElapsed("model.addOrSetSharesToPosition", time.Now())
-	ex, _ := redis.HExists("acct:"+accountID+":positions", symbol)
-
-	if ex {
-		return m.addSharesToPosition(accountID, symbol, amount)
-	}
-	// Check if exists in postgres
-	fetchQuery := fmt.Sprintf(`SELECT amount FROM position WHERE account_id='%s' AND symbol='%s'`, accountID, symbol)
-	var currentAmount float64
-	currentAmount = amount
-	sqlErr := m.db.QueryRow(fetchQuery).Scan(&currentAmount)
-	err = redis.SetField("acct:"+accountID+":positions", symbol, currentAmount)
-	// If was in the db, still need to add the amount
-	if sqlErr == nil {
-		m.addSharesToPosition(accountID, symbol, amount)
-	} else {
-		// Create in DB
-		sqlQuery := fmt.Sprintf(`INSERT INTO position(account_id, symbol, amount) VALUES('%s', '%s', %f)`, accountID, symbol, amount)
-		m.submitQuery(sqlQuery)
+	if err = m.cachePosition(accountID, symbol); err != nil {
+		return
+	}
+	if _, err = redis.HIncrBy("acct:"+accountID+":positions", symbol, amount.Units()); err != nil {
+		return
 	}
+	m.submitQuery(`INSERT INTO position(account_id, symbol, amount) VALUES($1, $2, $3) ON CONFLICT (account_id, symbol) DO UPDATE SET amount = position.amount + $3`, accountID, symbol, amount)
+	return
+}
 
+// cachePosition loads a position into the cache if it isn't there, so that
+// changes can be applied to it as increments.
+func (m *Model) cachePosition(accountID string, symbol string) (err error) {
+	key := "acct:" + accountID + ":positions"
+	if ex, _ := redis.HExists(key, symbol); ex {
+		return
+	}
+	var stored decimal.Decimal
+	err = m.db.QueryRow(`SELECT amount FROM position WHERE account_id=$1 AND symbol=$2`, accountID, symbol).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return
+	}
+	// a concurrent credit may have loaded it first, so only fill a gap
+	_, err = redis.SetFieldNX(key, symbol, stored)
 	return
 }
 
-func (m *Model) addSharesToPosition(accountID string, symbol string, amount float64) (err error) {
+func (m *Model) addSharesToPosition(accountID string, symbol string, amount decimal.Decimal) (err error) {
 	defer LogMethodTimeElapsed("model.addSharesToPosition", time.Now())
-	_, err = redis.HIncrByFloat("acct:"+accountID+":positions", symbol, amount)
+	_, err = redis.HIncrBy("acct:"+accountID+":positions", symbol, amount.Units())
 
-	sqlQuery := fmt.Sprintf(`UPDATE position SET amount=amount+%f WHERE account_id = '%s' AND symbol='%s'`, amount, accountID, symbol)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`UPDATE position SET amount=amount+$1 WHERE account_id = $2 AND symbol=$3`, amount, accountID, symbol)
 
 	return
 }
 
-// func (m *Model) updatePosition(accountID string, symbol string, amount float64) (err error) {
-// 	positionExists := false
-// 	fetchQuery := fmt.Sprintf(`SELECT amount FROM position WHERE account_id='%s' AND symbol='%s'`, accountID, symbol)
-// 	var currentAmount float64
-// 	err = m.db.QueryRow(fetchQuery).Scan(&currentAmount)
-// 	positionExists = err == nil
-// 	if !positionExists {
-// 		// TODO: Write to cache
-// 		sqlQuery := fmt.Sprintf(`INSERT INTO position(account_id, symbol, amount) VALUES('%s', '%s', %f)`, accountID, symbol, amount)
-// 		m.submitQuery(sqlQuery)
-// 		return nil
-// 	}
-// 	sqlQuery := fmt.Sprintf(`UPDATE position SET amount=%f WHERE account_id = '%s' AND symbol='%s'`, currentAmount+amount, accountID, symbol)
-// 	m.submitQuery(sqlQuery)
-// 	return nil
-// }
-
 func (m *Model) removePosition(accountID string, symbol string) (err error) {
 	defer LogMethodTimeElapsed("model.removePosition", time.Now())
-	sqlQuery := fmt.Sprintf(`DELETE FROM position WHERE account_id='%s' AND symbol='%s';`, accountID, symbol)
-	m.submitQuery(sqlQuery)
+	m.submitQuery(`DELETE FROM position WHERE account_id=$1 AND symbol=$2`, accountID, symbol)
 	return nil
 }
 
-func (m *Model) getPositionAmount(accountID string, symbol string) (amount float64, err error) {
+func (m *Model) getPositionAmount(accountID string, symbol string) (amount decimal.Decimal, err error) {
 	defer LogMethodTimeElapsed("model.getPositionAmount", time.Now())
 	var bal interface{}
 	bal, err = redis.GetField("acct:"+accountID+":positions", symbol)
@@ -580,12 +916,12 @@ func (m *Model) getPositionAmount(accountID string, symbol string) (amount float
 		return
 	}
 	if bal != nil {
-		amount, err = strconv.ParseFloat(string(bal.([]byte)), 64)
+		err = amount.RedisScan(bal)
 		return
 	} else {
-		sqlQuery := fmt.Sprintf(`SELECT amount FROM position WHERE account_id='%s' AND symbol='%s';`, accountID, symbol)
+		sqlQuery := `SELECT amount FROM position WHERE account_id=$1 AND symbol=$2`
 		// println("QUERY: ", sqlQuery)
-		err = m.db.QueryRow(sqlQuery).Scan(&amount)
+		err = m.db.QueryRow(sqlQuery, accountID, symbol).Scan(&amount)
 
 		if err != nil {
 			err = fmt.Errorf("User owns no shares of %s", symbol)
@@ -598,31 +934,200 @@ func (m *Model) getPositionAmount(accountID string, symbol string) (amount float
 
 }
 
+// getPositions reads every position the account holds, by symbol, from
+// the cache, which warmCache fills from Postgres at startup.
+func (m *Model) getPositions(accountID string) (positions map[string]decimal.Decimal, err error) {
+	defer LogMethodTimeElapsed("model.getPositions", time.Now())
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	fields, err := redigo.StringMap(conn.Do("HGETALL", "acct:"+accountID+":positions"))
+	if err != nil {
+		return
+	}
+	positions = make(map[string]decimal.Decimal)
+	for symbol, units := range fields {
+		var amount decimal.Decimal
+		if amount, err = decimal.ParseUnits(units); err != nil {
+			return
+		}
+		positions[symbol] = amount
+	}
+	return
+}
+
 /// Implementation / private
 
 func confirmDelete(deleteQuery string) {
-	print("Deleting entity with query: ")
-	println(deleteQuery)
+	log.WithFields(log.Fields{
+		"query": deleteQuery,
+	}).Debug("Deleted entity")
 }
 
-func (m *Model) submitQuery(query string) {
+// submitQuery queues a statement for Postgres. Client supplied values must
+// only ever be passed as args, never spliced into query.
+func (m *Model) submitQuery(query string, args ...interface{}) {
 	defer LogMethodTimeElapsed("model.submitQuery", time.Now())
-	m.commands <- query
-	if len(m.commands) >= bufferCapacity {
+	cmd := newSQLCommand(query, args...)
+	if m.batch != nil {
+		*m.batch = append(*m.batch, cmd)
+		return
+	}
+	m.enqueue([]sqlCommand{cmd})
+}
+
+// enqueue journals a batch and buffers it for Postgres.
+func (m *Model) enqueue(queries []sqlCommand) {
+	queue_mux.Lock()
+	entry := journalEntry{queries: queries}
+	if m.journal != nil {
+		var err error
+		entry, err = m.journal.append(queries)
+		if err != nil {
+			log.Fatal("JOURNAL ERROR: ", err)
+		}
+	}
+	m.commands <- entry
+	queue_mux.Unlock()
+
+	if len(m.commands) >= config.BufferCapacity {
 		m.executeQueries()
 	}
 }
 
+// syncJournal makes every statement queued so far durable. It is called
+// before a response is sent, so whatever a client has been told survives a
+// crash even while the statements wait in the buffer.
+func (m *Model) syncJournal() {
+	if m.journal == nil {
+		return
+	}
+	if err := m.journal.Sync(); err != nil {
+		log.Fatal("JOURNAL ERROR: ", err)
+	}
+}
+
+// recoverJournal opens the journal at path and applies whatever Postgres has
+// not yet seen. It must run before the exchange starts taking requests.
+func (m *Model) recoverJournal(path string) (err error) {
+	defer LogMethodTimeElapsed("model.recoverJournal", time.Now())
+	journal, err := OpenJournal(path)
+	if err != nil {
+		return
+	}
+	entries, err := journal.entries()
+	if err != nil {
+		return
+	}
+
+	var checkpoint uint64
+	err = m.db.QueryRow(`SELECT seq FROM journal_checkpoint WHERE id = 1`).Scan(&checkpoint)
+	if err != nil {
+		return
+	}
+
+	replayed := 0
+	last := checkpoint
+	var rejected *rejectedEntry
+	for _, entry := range entries {
+		if entry.seq <= checkpoint {
+			continue
+		}
+		last = entry.seq
+		if rejected != nil {
+			continue
+		}
+		if err = m.applyEntry(entry); err != nil {
+			rejected = &rejectedEntry{seq: entry.seq, err: err}
+			continue
+		}
+		checkpoint = entry.seq
+		replayed++
+	}
+	log.WithFields(log.Fields{
+		"journaled":  len(entries),
+		"replayed":   replayed,
+		"checkpoint": checkpoint,
+	}).Info("Recovered SQL journal")
+
+	journal.startAfter(last)
+	m.journal = journal
+	if rejected != nil {
+		rejected.through = last
+		return rejected
+	}
+	return journal.truncateThrough(checkpoint)
+}
+
+// rejectedEntry is the error recoverJournal returns when Postgres refuses a
+// journaled batch. That batch and every later one are left unapplied, since
+// they were acknowledged and are already in the cache; reconcile can write
+// them into Postgres from the cache and then skip them.
+type rejectedEntry struct {
+	seq     uint64 // the batch refused
+	through uint64 // the last batch held back behind it
+	err     error
+}
+
+func (r *rejectedEntry) Error() string {
+	return fmt.Sprintf("Postgres rejected journal entry %d, so entries %d to %d are not applied (see matching_engine reconcile): %v", r.seq, r.seq, r.through, r.err)
+}
+
+// skipJournal marks every entry up to seq as applied without applying it,
+// once Postgres has been repaired to include what they did.
+func (m *Model) skipJournal(seq uint64) (err error) {
+	if _, err = m.db.Exec(`UPDATE journal_checkpoint SET seq = $1 WHERE id = 1`, seq); err != nil {
+		return
+	}
+	return m.journal.truncateThrough(seq)
+}
+
+// applyEntry runs a batch and advances the checkpoint in one transaction.
+// If any statement fails the whole batch is rolled back and the checkpoint
+// stays where it was, so no request is ever half applied or passed over.
+func (m *Model) applyEntry(entry journalEntry) (err error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return
+	}
+	for _, cmd := range entry.queries {
+		log.WithFields(log.Fields{
+			"query": cmd.Query,
+		}).Debug("Executing query")
+		if _, err = tx.Exec(cmd.Query, cmd.args()...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v -- query: %s %q", err, cmd.Query, cmd.Args)
+		}
+	}
+	if entry.seq != 0 {
+		if _, err = tx.Exec(`UPDATE journal_checkpoint SET seq = $1 WHERE id = 1`, entry.seq); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+	return tx.Commit()
+}
+
 func (m *Model) executeQueries() {
 	defer LogMethodTimeElapsed("model.executeQueries", time.Now())
-	log.Info(fmt.Sprintf("Flushing SQL commands. There are %d commands in the buffer.", len(m.commands)))
+	flush_mux.Lock()
+	defer flush_mux.Unlock()
+
+	// whatever Postgres refused last time goes first, so batches are never
+	// applied out of order
+	entries := heldEntries
+	heldEntries = nil
 	for len(m.commands) > 0 {
-		s := <-m.commands
-		println("EXECUTING QUERY: ", s)
-		var query string
-		isDelete := strings.HasPrefix(s, "DELETE")
-		if isDelete {
-			query = s
+		entries = append(entries, <-m.commands)
+	}
+
+	log.Info(fmt.Sprintf("Flushing SQL commands. There are %d commands in the buffer.", len(entries)))
+	var last uint64
+	for i, entry := range entries {
+		var deletes []string
+		for _, cmd := range entry.queries {
+			if strings.HasPrefix(cmd.Query, "DELETE") {
+				deletes = append(deletes, fmt.Sprintf("%s %q", cmd.Query, cmd.Args))
+			}
 		}
 		// reportProblem := func(ev pq.ListenerEventType, err error) {
 		// 	if err != nil {
@@ -633,13 +1138,29 @@ func (m *Model) executeQueries() {
 		// TODO: Set up listener for record update to cache
 		// listener := pq.NewListener(dbInfoString(), 10*time.Second, time.Minute, reportProblem)
 		// listener := pq.NewListener()
-		_, err := m.db.Exec(s)
-		if err != nil {
-			log.Error(fmt.Sprintf(`SQL database error: %v -- query: %s`, err, s))
+		if err := m.applyEntry(entry); err != nil {
+			// The request was acknowledged and the cache already has it, so
+			// it can't be dropped. It and everything after it stay in the
+			// journal and are retried on every flush until Postgres takes
+			// them; if it never will, stop the exchange and run reconcile.
+			heldEntries = entries[i:]
+			log.WithFields(log.Fields{
+				"entry": entry.seq,
+				"held":  len(heldEntries),
+				"error": err,
+			}).Error("Postgres rejected a journal entry; holding it and every later one")
+			break
 		}
-		if isDelete {
+		for _, query := range deletes {
 			// Dispatch to other thread?
 			go confirmDelete(query)
 		}
+		last = entry.seq
+	}
+
+	if m.journal != nil && last != 0 {
+		if err := m.journal.truncateThrough(last); err != nil {
+			log.Error("Failed to truncate journal: ", err)
+		}
 	}
 }
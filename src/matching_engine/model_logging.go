@@ -1,141 +1,80 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func outputDatabaseStateTruncated(rowLimit int) {
-	SharedModel().executeQueries()
-
-	outputAccounts(rowLimit)
-	outputSymbols(rowLimit)
-	outputPositions(rowLimit)
-	outputBuyOrders(rowLimit)
-	outputSellOrders(rowLimit)
-	outputTransactions(rowLimit)
-}
-
 func logAccount(acctId string) {
-	bal, _ := SharedModel().getAccountBalance(acctId)
+	bal, reserved, _ := SharedStore().getAccountFunds(acctId)
 
 	log.WithFields(log.Fields{
 		"ID":             acctId,
 		"Balance":        bal,
+		"Reserved":       reserved,
 	}).Info("Log Account")
 }
 
-func outputAccounts(rowLimit int) {
-	tableName := "account"
-	rows, err := SharedModel().db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit))
-	println("QUERY: ", fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit))
-	if err != nil {
-		log.Info("Error attempting to print accounts: ", err)
-		return
-	}
-	var uid string
-	var balance float64
-	println("\n#######  ACCOUNTS:")
-	for rows.Next() {
-		err = rows.Scan(&uid, &balance)
-		println(fmt.Sprintf("AccountID: %s -- Balance: %f", uid, balance))
-	}
-}
-
-func outputSymbols(rowLimit int) {
-	tableName := "symbol"
-	var symbol string
-
-	rows, err := SharedModel().db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit))
-	if err != nil {
-		log.Info("Error attempting to print symbols: ", err)
-		return
-	}
-	println("\n#######  SYMBOLS: ")
-	for rows.Next() {
-		err = rows.Scan(&symbol)
-		println(fmt.Sprintf("Symbol: %s", symbol))
-	}
-}
-
-func outputPositions(rowLimit int) {
-	tableName := "position"
-	var accountID string
-	var symbol string
-	var amount float64
+// dumpRows reads up to limit rows of a table from Postgres, in key order.
+// Only the names in t, never client values, are put into the query.
+func (m *Model) dumpRows(t dumpTable, filter dumpFilter, limit int) (rows [][]string, err error) {
+	defer LogMethodTimeElapsed("model.dumpRows", time.Now())
 
-	sqlQuery := fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit)
-	rows, err := SharedModel().db.Query(sqlQuery)
-	if err != nil {
-		log.Info("Error attempting to print positions: ", err)
-		return
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
 	}
-	println("\n#######  POSITIONS: ")
-	for rows.Next() {
-		err = rows.Scan(&accountID, &symbol, &amount)
-		println(fmt.Sprintf("AccountID: %s -- Symbol: %s -- Amount: %f", accountID, symbol, amount))
+	if filter.account != "" {
+		n := arg(filter.account)
+		var matches []string
+		for _, column := range t.account {
+			matches = append(matches, column+" = "+n)
+		}
+		where = append(where, "("+strings.Join(matches, " OR ")+")")
 	}
-}
-
-func outputBuyOrders(rowLimit int) {
-	tableName := "buy_order"
-	var uid string
-	var accountID string
-	var symbol string
-	var priceLimit float64
-	var amount float64
-
-	sqlQuery := fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit)
-	rows, err := SharedModel().db.Query(sqlQuery)
-	if err != nil {
-		log.Info("Error attempting to print buy orders: ", err)
-		return
+	if filter.symbol != "" {
+		where = append(where, t.symbol+" = "+arg(filter.symbol))
 	}
-	println("\n#######  BUY ORDERS: ")
-	for rows.Next() {
-		err = rows.Scan(&uid, &accountID, &symbol, &priceLimit, &amount)
-		println(fmt.Sprintf("UID: %s -- AccountID: %s -- Symbol: %s -- PriceLimit: %f -- Amount: %f", uid, accountID, symbol, priceLimit, amount))
+	if filter.after != nil {
+		var after []string
+		for _, v := range filter.after {
+			after = append(after, arg(v))
+		}
+		where = append(where, "("+strings.Join(t.key, ", ")+") > ("+strings.Join(after, ", ")+")")
 	}
-}
-
-func outputSellOrders(rowLimit int) {
-	tableName := "sell_order"
-	var uid string
-	var accountID string
-	var symbol string
-	var priceLimit float64
-	var amount float64
 
-	rows, err := SharedModel().db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit))
-	if err != nil {
-		log.Info("Error attempting to print sell orders: ", err)
-		return
+	query := "SELECT " + strings.Join(t.columns, ", ") + " FROM " + t.name
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
 	}
-	println("\n#######  SELL ORDERS: ")
-	for rows.Next() {
-		err = rows.Scan(&uid, &accountID, &symbol, &priceLimit, &amount)
-		println(fmt.Sprintf("UID: %s -- AccountID: %s -- Symbol: %s -- PriceLimit: %f -- Amount: %f", uid, accountID, symbol, priceLimit, amount))
-	}
-}
-
-func outputTransactions(rowLimit int) {
-	tableName := "transaction"
-	var uid string
-	var symbol string
-	var amount float64
-	var price float64
-	var transactionTime time.Time
+	query += " ORDER BY " + strings.Join(t.key, ", ") + " LIMIT " + arg(limit)
 
-	rows, err := SharedModel().db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT %d", tableName, rowLimit))
+	result, err := m.db.Query(query, args...)
 	if err != nil {
-		log.Info("Error attempting to print transactions: ", err)
 		return
 	}
-	println("\n#######  TRANSACTIONS: ")
-	for rows.Next() {
-		err = rows.Scan(&uid, &symbol, &amount, &price, &transactionTime)
-		println(fmt.Sprintf("UID: %s -- Symbol: %s -- Amount: %f -- Price: %f -- TransactionTime: %v", uid, symbol, amount, price, transactionTime))
+	defer result.Close()
+	for result.Next() {
+		values := make([]sql.NullString, len(t.columns))
+		dest := make([]interface{}, len(values))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = result.Scan(dest...); err != nil {
+			return
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		rows = append(rows, row)
 	}
+	err = result.Err()
+	return
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/farice/EME/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// bookOrder is an open order resting in (or about to enter) an order book.
+type bookOrder struct {
+	id       string
+	account  string
+	sym      string
+	buy      bool
+	limit    decimal.Decimal
+	amount   decimal.Decimal // shares left to execute, always positive
+	reserved decimal.Decimal // cash a buy still holds for them at its limit
+	seq      uint64          // arrival sequence within the book, breaks price ties
+}
+
+// release gives up the part of a buy's reservation held for shares of it
+// that are filled or canceled: in proportion to what is left of the order,
+// or everything once they are all of it, so that what an order releases
+// adds up to exactly what it reserved. o.amount is left to the caller.
+func (o *bookOrder) release(shares decimal.Decimal) (released decimal.Decimal) {
+	released = o.reserved
+	if shares.Cmp(o.amount) < 0 {
+		released = o.reserved.MulDiv(shares, o.amount)
+	}
+	o.reserved = o.reserved.Sub(released)
+	return
+}
+
+// priceLevel holds every resting order at a single price, lowest seq first.
+type priceLevel struct {
+	price  decimal.Decimal
+	orders []*bookOrder
+}
+
+// OrderBook is the in-memory book of open orders for a single symbol.
+// Bids are kept best (highest) first, asks best (lowest) first.
+type OrderBook struct {
+	sym     string
+	bids    []*priceLevel
+	asks    []*priceLevel
+	orders  map[string]*bookOrder
+	nextSeq uint64
+}
+
+var (
+	books     = make(map[string]*OrderBook)
+	books_mux sync.Mutex
+)
+
+func NewOrderBook(sym string) *OrderBook {
+	return &OrderBook{
+		sym:    sym,
+		orders: make(map[string]*bookOrder),
+	}
+}
+
+// getBook returns the book for sym, loading its open orders from the cache
+// the first time the symbol is seen.
+func getBook(sym string) *OrderBook {
+	books_mux.Lock()
+	defer books_mux.Unlock()
+
+	book, ok := books[sym]
+	if ok {
+		return book
+	}
+
+	book = NewOrderBook(sym)
+	book.load(true)
+	book.load(false)
+	books[sym] = book
+	return book
+}
+
+// loadedBook returns the book for sym if it has been loaded, without loading it.
+func loadedBook(sym string) (book *OrderBook, ok bool) {
+	books_mux.Lock()
+	defer books_mux.Unlock()
+	book, ok = books[sym]
+	return
+}
+
+// load fills one side of the book from the open-buy:/open-sell: sorted sets.
+// Orders rested before sequencing was recorded arrived first, in id order,
+// so they queue ahead of the rest, which keep their recorded order.
+func (b *OrderBook) load(buy bool) {
+	ids, err := SharedStore().getOpenOrders(b.sym, buy)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sym":   b.sym,
+			"error": err,
+		}).Error("Failed to load open orders into book")
+		return
+	}
+
+	var sequenced, unsequenced []*bookOrder
+	for _, id := range ids {
+		data, err := SharedStore().getOrder(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"transId": id,
+				"error":   err,
+			}).Error("Corrupted data: open order info")
+			continue
+		}
+		o := &bookOrder{id: id, account: data.account, sym: b.sym, buy: buy, limit: data.limit, amount: data.amount.Abs(), reserved: data.reserved}
+		if o.seq, err = SharedStore().getOrderSeq(id); err != nil || o.seq == 0 {
+			unsequenced = append(unsequenced, o)
+		} else {
+			sequenced = append(sequenced, o)
+		}
+	}
+
+	// ids come from another counter than seqs, so they only order each other
+	sort.Slice(unsequenced, func(i, j int) bool {
+		x, _ := strconv.ParseUint(unsequenced[i].id, 10, 64)
+		y, _ := strconv.ParseUint(unsequenced[j].id, 10, 64)
+		return x < y
+	})
+	for i, o := range unsequenced {
+		o.seq = uint64(i + 1)
+	}
+	for _, o := range sequenced {
+		o.seq += uint64(len(unsequenced))
+	}
+	// add keeps nextSeq at the largest seq seen, so new orders queue last
+	for _, o := range append(unsequenced, sequenced...) {
+		b.add(o)
+	}
+}
+
+func (b *OrderBook) side(buy bool) *[]*priceLevel {
+	if buy {
+		return &b.bids
+	}
+	return &b.asks
+}
+
+// levelIndex returns the position at which price is, or would be, found on a side.
+func (b *OrderBook) levelIndex(buy bool, price decimal.Decimal) int {
+	levels := *b.side(buy)
+	return sort.Search(len(levels), func(i int) bool {
+		if buy {
+			return levels[i].price.Cmp(price) <= 0
+		}
+		return levels[i].price.Cmp(price) >= 0
+	})
+}
+
+// add places o in the queue for its price. An order without a seq is
+// stamped with the next one and so joins the back of the queue; an order
+// that already carries one (reloaded from the cache) takes its old place.
+func (b *OrderBook) add(o *bookOrder) {
+	if o.seq == 0 {
+		b.nextSeq++
+		o.seq = b.nextSeq
+	} else if o.seq > b.nextSeq {
+		b.nextSeq = o.seq
+	}
+
+	levels := b.side(o.buy)
+	i := b.levelIndex(o.buy, o.limit)
+	if i == len(*levels) || (*levels)[i].price.Cmp(o.limit) != 0 {
+		*levels = append(*levels, nil)
+		copy((*levels)[i+1:], (*levels)[i:])
+		(*levels)[i] = &priceLevel{price: o.limit}
+	}
+	level := (*levels)[i]
+	j := sort.Search(len(level.orders), func(k int) bool {
+		return level.orders[k].seq > o.seq
+	})
+	level.orders = append(level.orders, nil)
+	copy(level.orders[j+1:], level.orders[j:])
+	level.orders[j] = o
+	b.orders[o.id] = o
+}
+
+// remove takes the order with the given id out of the book, if present.
+func (b *OrderBook) remove(id string) {
+	o, ok := b.orders[id]
+	if !ok {
+		return
+	}
+	delete(b.orders, id)
+
+	levels := b.side(o.buy)
+	i := b.levelIndex(o.buy, o.limit)
+	if i == len(*levels) || (*levels)[i].price.Cmp(o.limit) != 0 {
+		return
+	}
+	level := (*levels)[i]
+	for j, queued := range level.orders {
+		if queued.id == id {
+			level.orders = append(level.orders[:j], level.orders[j+1:]...)
+			break
+		}
+	}
+	if len(level.orders) == 0 {
+		*levels = append((*levels)[:i], (*levels)[i+1:]...)
+	}
+}
+
+// best returns the first order in the queue at the best price on a side.
+func (b *OrderBook) best(buy bool) *bookOrder {
+	levels := *b.side(buy)
+	if len(levels) == 0 {
+		return nil
+	}
+	return levels[0].orders[0]
+}
+
+// levels returns one side of the book, best price first.
+func (b *OrderBook) levels(buy bool) []*priceLevel {
+	return *b.side(buy)
+}
+
+func (b *OrderBook) get(id string) (o *bookOrder, ok bool) {
+	o, ok = b.orders[id]
+	return
+}
+
+// depthLevel is every order resting at one price, added up.
+type depthLevel struct {
+	price  decimal.Decimal
+	shares decimal.Decimal
+	orders int
+}
+
+// depth returns one side of the book by price level, best price first.
+func (b *OrderBook) depth(buy bool) []depthLevel {
+	levels := b.levels(buy)
+	depth := make([]depthLevel, 0, len(levels))
+	for _, level := range levels {
+		d := depthLevel{price: level.price, orders: len(level.orders)}
+		for _, o := range level.orders {
+			d.shares = d.shares.Add(o.amount)
+		}
+		depth = append(depth, d)
+	}
+	return depth
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queue lists the ids at one price level of a side, in the order they fill.
+func queue(b *OrderBook, buy bool, level int) (ids []string) {
+	for _, o := range b.levels(buy)[level].orders {
+		ids = append(ids, o.id)
+	}
+	return
+}
+
+func TestBookPriceTimeOrder(t *testing.T) {
+	b := NewOrderBook("SPY")
+	for _, o := range []struct {
+		id, limit string
+		buy       bool
+	}{
+		{"1", "10", true},
+		{"2", "11", true},
+		{"3", "10", true},
+		{"4", "12", false},
+		{"5", "11.5", false},
+		{"6", "12", false},
+	} {
+		b.add(&bookOrder{id: o.id, sym: "SPY", buy: o.buy, limit: dec(t, o.limit), amount: dec(t, "1")})
+	}
+
+	if best := b.best(true); best.id != "2" {
+		t.Errorf("best bid %s, want 2", best.id)
+	}
+	if best := b.best(false); best.id != "5" {
+		t.Errorf("best ask %s, want 5", best.id)
+	}
+	if got := queue(b, true, 1); !reflect.DeepEqual(got, []string{"1", "3"}) {
+		t.Errorf("bids at 10 %v, want 1 then 3", got)
+	}
+	if got := queue(b, false, 1); !reflect.DeepEqual(got, []string{"4", "6"}) {
+		t.Errorf("asks at 12 %v, want 4 then 6", got)
+	}
+
+	b.remove("1")
+	if got := queue(b, true, 1); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("bids at 10 after removing 1: %v", got)
+	}
+}
+
+// Orders rested before their seq was recorded go ahead of those that have
+// one, in id order, and orders added after loading go behind all of them.
+func TestBookLoadOrder(t *testing.T) {
+	m := reset()
+	for _, o := range []struct {
+		id  string
+		seq uint64
+	}{
+		{"40", 2},
+		{"30", 0},
+		{"2", 1},
+		{"7", 0},
+	} {
+		m.createOrder(o.id, "1", "SPY", dec(t, "10"), dec(t, "1"), time.Now())
+		if err := m.createBuyOrder(o.id, "1", "SPY", dec(t, "1"), dec(t, "10"), dec(t, "10"), o.seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := getBook("SPY")
+	if got := queue(b, true, 0); !reflect.DeepEqual(got, []string{"7", "30", "2", "40"}) {
+		t.Errorf("loaded %v, want 7, 30, 2, 40", got)
+	}
+	b.add(&bookOrder{id: "41", sym: "SPY", buy: true, limit: dec(t, "10"), amount: dec(t, "1")})
+	if got := queue(b, true, 0); got[len(got)-1] != "41" {
+		t.Errorf("after adding 41: %v, want it last", got)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/farice/EME/decimal"
+	"github.com/farice/EME/redis"
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Which side a reconcile repair overwrites
+const (
+	repairNone  = ""
+	repairCache = "cache" // make Redis match Postgres
+	repairDB    = "db"    // make Postgres match Redis
+)
+
+// discrepancy is one place where the cache and the database disagree, with
+// the changes that would bring either side in line with the other. A nil
+// fix means that direction can't be repaired automatically.
+type discrepancy struct {
+	kind     string
+	id       string
+	cache    string
+	postgres string
+	toCache  func(conn redigo.Conn) error
+	toDB     func(tx *sql.Tx) error
+}
+
+// An order as stored in buy_order/sell_order
+type storedOrder struct {
+	buy      bool
+	account  string
+	symbol   string
+	limit    decimal.Decimal
+	amount   decimal.Decimal
+	reserved decimal.Decimal // zero for sells
+	seq      sql.NullInt64
+}
+
+// An order as found in the open-buy:/open-sell: sets and its order: hash
+type cachedOrder struct {
+	buy     bool
+	symbol  string
+	limit   decimal.Decimal
+	open    bool // in an open set
+	info    orderInfo
+	hasInfo bool
+	seq     uint64
+}
+
+func display(d decimal.Decimal, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return d.String()
+}
+
+// runReconcile implements `matching_engine reconcile [-repair=cache|db]`.
+// It compares every account, position and open order in Redis with Postgres
+// and prints what differs. The exchange must be stopped while it runs, or
+// statements still waiting in its buffer show up as differences. It is also
+// how a journal entry Postgres refuses is resolved: -repair=db writes what
+// the held entries did from the cache, then marks them applied.
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	repair := flags.String("repair", repairNone, "overwrite one side with the other: \"cache\" (from Postgres) or \"db\" (from Redis)")
+	if err := loadConfig(flags, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	openLogs()
+	config.logConfig()
+
+	if *repair != repairNone && *repair != repairCache && *repair != repairDB {
+		fmt.Fprintf(os.Stderr, "unknown repair mode %q\n", *repair)
+		return 2
+	}
+
+	redis.Init(config.RedisHost, config.RedisMaxIdle)
+	m := SharedModel()
+	// the diff is only meaningful once everything acknowledged has reached
+	// Postgres, except what Postgres refuses, which the diff then shows
+	err := m.recoverJournal(config.JournalPath)
+	rejected, _ := err.(*rejectedEntry)
+	if err != nil && rejected == nil {
+		log.Error("Failed to recover SQL journal: ", err)
+		return 1
+	}
+	if rejected != nil {
+		fmt.Println(rejected.Error())
+	}
+
+	diffs, err := m.reconcile()
+	if err != nil {
+		log.Error("Reconciliation failed: ", err)
+		return 1
+	}
+
+	for _, d := range diffs {
+		fmt.Printf("%-28s %-30s cache=%-20s postgres=%s\n", d.kind, d.id, d.cache, d.postgres)
+	}
+	fmt.Printf("%d discrepancies\n", len(diffs))
+	if len(diffs) == 0 && rejected == nil {
+		return 0
+	}
+	if *repair == repairNone {
+		return 1
+	}
+	// the cache holds the refused requests, so only Postgres can take them
+	if rejected != nil && *repair != repairDB {
+		fmt.Println("journal entries Postgres refused can only be resolved with -repair=db")
+		return 1
+	}
+
+	repaired, skipped, err := m.repair(diffs, *repair)
+	fmt.Printf("repaired %d, could not repair %d\n", repaired, skipped)
+	if err != nil {
+		log.Error("Repair failed: ", err)
+		return 1
+	}
+	if skipped > 0 {
+		return 1
+	}
+	if rejected != nil {
+		// Postgres now has what they did to balances, positions and orders
+		if err = m.skipJournal(rejected.through); err != nil {
+			log.Error("Failed to skip journal entries: ", err)
+			return 1
+		}
+		fmt.Printf("skipped journal entries %d to %d; their executions and order history are not in Postgres\n", rejected.seq, rejected.through)
+	}
+	return 0
+}
+
+// reconcile collects every discrepancy between Redis and Postgres.
+func (m *Model) reconcile() (diffs []discrepancy, err error) {
+	accounts, err := m.reconcileAccounts()
+	if err != nil {
+		return
+	}
+	reserved, err := m.reconcileReserved()
+	if err != nil {
+		return
+	}
+	accounts = append(accounts, reserved...)
+	positions, err := m.reconcilePositions()
+	if err != nil {
+		return
+	}
+	orders, err := m.reconcileOrders()
+	if err != nil {
+		return
+	}
+	diffs = append(append(accounts, positions...), orders...)
+	return
+}
+
+func (m *Model) reconcileAccounts() (diffs []discrepancy, err error) {
+	stored := make(map[string]decimal.Decimal)
+	rows, err := m.db.Query(`SELECT uid, balance FROM account`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		var balance decimal.Decimal
+		if err = rows.Scan(&uid, &balance); err != nil {
+			return
+		}
+		stored[uid] = balance
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	cached := make(map[string]decimal.Decimal)
+	keys, err := redis.GetKeys("acct:*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":positions") {
+			continue
+		}
+		bal, _ := redis.GetField(key, "balance")
+		if bal == nil {
+			continue
+		}
+		var balance decimal.Decimal
+		if err = balance.RedisScan(bal); err != nil {
+			return
+		}
+		cached[strings.TrimPrefix(key, "acct:")] = balance
+	}
+
+	for _, uid := range unionKeys(stored, cached) {
+		uid := uid
+		s, inDB := stored[uid]
+		c, inCache := cached[uid]
+		if inDB && inCache && s.Cmp(c) == 0 {
+			continue
+		}
+		d := discrepancy{kind: "account balance", id: uid, cache: display(c, inCache), postgres: display(s, inDB)}
+		if inDB {
+			d.toCache = func(conn redigo.Conn) (err error) {
+				_, err = conn.Do("HSET", "acct:"+uid, "balance", s)
+				return
+			}
+		} else {
+			d.toCache = func(conn redigo.Conn) (err error) {
+				_, err = conn.Do("DEL", "acct:"+uid, "acct:"+uid+":positions")
+				return
+			}
+		}
+		if inCache {
+			d.toDB = func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`INSERT INTO account(uid, balance) VALUES($1, $2) ON CONFLICT (uid) DO UPDATE SET balance = $2`, uid, c)
+				return
+			}
+		} else {
+			d.toDB = func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`DELETE FROM account WHERE uid=$1`, uid)
+				return
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return
+}
+
+// reconcileReserved compares the cash set aside by resting buys, for the
+// accounts both sides have. Accounts only one side has are already reported
+// by reconcileAccounts.
+func (m *Model) reconcileReserved() (diffs []discrepancy, err error) {
+	rows, err := m.db.Query(`SELECT uid, reserved FROM account`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		var s decimal.Decimal
+		if err = rows.Scan(&uid, &s); err != nil {
+			return
+		}
+		if ex, _ := redis.HExists("acct:"+uid, "balance"); !ex {
+			continue
+		}
+		var c decimal.Decimal
+		if cached, _ := redis.GetField("acct:"+uid, "reserved"); cached != nil {
+			if err = c.RedisScan(cached); err != nil {
+				return
+			}
+		}
+		if s.Cmp(c) == 0 {
+			continue
+		}
+		diffs = append(diffs, discrepancy{
+			kind:     "account reserved",
+			id:       uid,
+			cache:    c.String(),
+			postgres: s.String(),
+			toCache: func(conn redigo.Conn) (err error) {
+				_, err = conn.Do("HSET", "acct:"+uid, "reserved", s)
+				return
+			},
+			toDB: func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`UPDATE account SET reserved=$2 WHERE uid=$1`, uid, c)
+				return
+			},
+		})
+	}
+	err = rows.Err()
+	return
+}
+
+func (m *Model) reconcilePositions() (diffs []discrepancy, err error) {
+	// keyed by account + "\x00" + symbol
+	stored := make(map[string]decimal.Decimal)
+	rows, err := m.db.Query(`SELECT account_id, symbol, amount FROM position`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var accountID, symbol string
+		var amount decimal.Decimal
+		if err = rows.Scan(&accountID, &symbol, &amount); err != nil {
+			return
+		}
+		stored[accountID+"\x00"+symbol] = amount
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	cached := make(map[string]decimal.Decimal)
+	keys, err := redis.GetKeys("acct:*:positions")
+	if err != nil {
+		return
+	}
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	for _, key := range keys {
+		accountID := strings.TrimSuffix(strings.TrimPrefix(key, "acct:"), ":positions")
+		var fields map[string]string
+		fields, err = redigo.StringMap(conn.Do("HGETALL", key))
+		if err != nil {
+			return
+		}
+		for symbol, units := range fields {
+			var amount decimal.Decimal
+			if amount, err = decimal.ParseUnits(units); err != nil {
+				return
+			}
+			cached[accountID+"\x00"+symbol] = amount
+		}
+	}
+
+	for _, k := range unionKeys(stored, cached) {
+		parts := strings.SplitN(k, "\x00", 2)
+		accountID, symbol := parts[0], parts[1]
+		s, inDB := stored[k]
+		c, inCache := cached[k]
+		if inDB && inCache && s.Cmp(c) == 0 {
+			continue
+		}
+		d := discrepancy{kind: "position", id: accountID + " " + symbol, cache: display(c, inCache), postgres: display(s, inDB)}
+		if inDB {
+			d.toCache = func(conn redigo.Conn) (err error) {
+				_, err = conn.Do("HSET", "acct:"+accountID+":positions", symbol, s)
+				return
+			}
+		} else {
+			d.toCache = func(conn redigo.Conn) (err error) {
+				_, err = conn.Do("HDEL", "acct:"+accountID+":positions", symbol)
+				return
+			}
+		}
+		if inCache {
+			d.toDB = func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`INSERT INTO position(account_id, symbol, amount) VALUES($1, $2, $3) ON CONFLICT (account_id, symbol) DO UPDATE SET amount = $3`, accountID, symbol, c)
+				return
+			}
+		} else {
+			d.toDB = func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`DELETE FROM position WHERE account_id=$1 AND symbol=$2`, accountID, symbol)
+				return
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	return
+}
+
+func (m *Model) reconcileOrders() (diffs []discrepancy, err error) {
+	stored := make(map[string]storedOrder)
+	for _, buy := range []bool{true, false} {
+		table, reserved := "sell_order", "0"
+		if buy {
+			table, reserved = "buy_order", storedReservation
+		}
+		var rows *sql.Rows
+		rows, err = m.db.Query(`SELECT uid, account_id, symbol, price_limit, amount, ` + reserved + `, seq FROM ` + table)
+		if err != nil {
+			return
+		}
+		for rows.Next() {
+			var uid string
+			o := storedOrder{buy: buy}
+			if err = rows.Scan(&uid, &o.account, &o.symbol, &o.limit, &o.amount, &o.reserved, &o.seq); err != nil {
+				rows.Close()
+				return
+			}
+			stored[uid] = o
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return
+		}
+	}
+
+	cached := make(map[string]cachedOrder)
+	for _, buy := range []bool{true, false} {
+		prefix := "open-sell:"
+		if buy {
+			prefix = "open-buy:"
+		}
+		var keys []string
+		if keys, err = redis.GetKeys(prefix + "*"); err != nil {
+			return
+		}
+		for _, key := range keys {
+			members, _ := redis.Zrange(key, 0, -1, true)
+			for i := 0; i+1 < len(members); i += 2 {
+				var score decimal.Decimal
+				if score, err = decimal.ParseUnits(members[i+1]); err != nil {
+					return
+				}
+				cached[members[i]] = cachedOrder{buy: buy, symbol: strings.TrimPrefix(key, prefix), limit: score, open: true}
+			}
+		}
+	}
+	// order hashes that still have shares left but sit in no open set
+	keys, err := redis.GetKeys("order:*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		uid := strings.TrimPrefix(key, "order:")
+		info, infoErr := m.getOrder(uid)
+		if infoErr != nil {
+			continue
+		}
+		c := cached[uid]
+		c.info, c.hasInfo = info, true
+		c.seq, _ = m.getOrderSeq(uid)
+		if !c.open {
+			if info.amount.IsZero() {
+				continue
+			}
+			c.buy, c.symbol, c.limit = info.amount.Sign() > 0, info.symbol, info.limit
+		}
+		cached[uid] = c
+	}
+
+	ids := make([]string, 0, len(stored)+len(cached))
+	for uid := range stored {
+		ids = append(ids, uid)
+	}
+	for uid := range cached {
+		if _, ok := stored[uid]; !ok {
+			ids = append(ids, uid)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, uid := range ids {
+		uid := uid
+		s, inDB := stored[uid]
+		c, inCache := cached[uid]
+		table, set := "sell_order", "open-sell:"
+		if (inDB && s.buy) || (!inDB && c.buy) {
+			table, set = "buy_order", "open-buy:"
+		}
+
+		switch {
+		case inDB && !c.open:
+			d := discrepancy{kind: "order open only in postgres", id: uid, cache: display(c.info.amount, c.hasInfo), postgres: s.amount.String()}
+			d.toCache = func(conn redigo.Conn) (err error) {
+				if _, err = conn.Do("HMSET", "order:"+uid, "account", s.account, "symbol", s.symbol, "limit", s.limit, "amount", s.amount, "reserved", s.reserved); err != nil {
+					return
+				}
+				conn.Do("HSETNX", "order:"+uid, "origAmount", s.amount)
+				if s.seq.Valid {
+					conn.Do("HSET", "order:"+uid, "seq", s.seq.Int64)
+				}
+				_, err = conn.Do("ZADD", set+s.symbol, s.limit.Units(), uid)
+				return
+			}
+			d.toDB = func(tx *sql.Tx) (err error) {
+				_, err = tx.Exec(`DELETE FROM `+table+` WHERE uid=$1`, uid)
+				return
+			}
+			diffs = append(diffs, d)
+
+		case !inDB && inCache:
+			kind := "order open only in cache"
+			if !c.open {
+				kind = "order with shares left not in book"
+			}
+			d := discrepancy{kind: kind, id: uid, cache: display(c.info.amount, c.hasInfo), postgres: "-"}
+			d.toCache = func(conn redigo.Conn) (err error) {
+				if _, err = conn.Do("ZREM", set+c.symbol, uid); err != nil {
+					return
+				}
+				conn.Do("ZREM", "order-expiry", uid)
+				_, err = conn.Do("HSET", "order:"+uid, "amount", decimal.Zero)
+				return
+			}
+			if c.open && c.hasInfo {
+				d.toDB = func(tx *sql.Tx) (err error) {
+					_, err = tx.Exec(`INSERT INTO `+table+`(uid, account_id, symbol, amount, price_limit, seq) VALUES($1, $2, $3, $4, $5, $6)`,
+						uid, c.info.account, c.symbol, c.info.amount, c.limit, c.seq)
+					if err == nil && c.buy {
+						_, err = tx.Exec(`UPDATE buy_order SET reserved=$1 WHERE uid=$2`, c.info.reserved, uid)
+					}
+					return
+				}
+			}
+			diffs = append(diffs, d)
+
+		case inDB && (s.symbol != c.symbol || s.buy != c.buy || s.limit.Cmp(c.limit) != 0 || !c.hasInfo || s.amount.Cmp(c.info.amount) != 0 || s.reserved.Cmp(c.info.reserved) != 0):
+			d := discrepancy{
+				kind:     "order differs",
+				id:       uid,
+				cache:    fmt.Sprintf("%s %s@%s", c.symbol, display(c.info.amount, c.hasInfo), c.limit),
+				postgres: fmt.Sprintf("%s %s@%s", s.symbol, s.amount, s.limit),
+			}
+			d.toCache = func(conn redigo.Conn) (err error) {
+				if c.symbol != s.symbol || c.buy != s.buy {
+					cachedSet := "open-sell:"
+					if c.buy {
+						cachedSet = "open-buy:"
+					}
+					conn.Do("ZREM", cachedSet+c.symbol, uid)
+				}
+				if _, err = conn.Do("ZADD", set+s.symbol, s.limit.Units(), uid); err != nil {
+					return
+				}
+				_, err = conn.Do("HMSET", "order:"+uid, "account", s.account, "symbol", s.symbol, "limit", s.limit, "amount", s.amount, "reserved", s.reserved)
+				return
+			}
+			if c.hasInfo && c.buy == s.buy {
+				d.toDB = func(tx *sql.Tx) (err error) {
+					_, err = tx.Exec(`UPDATE `+table+` SET symbol=$1, price_limit=$2, amount=$3 WHERE uid=$4`, c.symbol, c.limit, c.info.amount, uid)
+					if err == nil && c.buy {
+						_, err = tx.Exec(`UPDATE buy_order SET reserved=$1 WHERE uid=$2`, c.info.reserved, uid)
+					}
+					return
+				}
+			}
+			diffs = append(diffs, d)
+		}
+	}
+	return
+}
+
+// repair applies the fix for every discrepancy in one direction. Database
+// fixes are made in a single transaction. Returns how many were fixed and
+// how many have no fix in that direction.
+func (m *Model) repair(diffs []discrepancy, mode string) (repaired int, skipped int, err error) {
+	if mode == repairCache {
+		conn := redis.Pool.Get()
+		defer conn.Close()
+		for _, d := range diffs {
+			if d.toCache == nil {
+				skipped++
+				continue
+			}
+			if err = d.toCache(conn); err != nil {
+				return
+			}
+			repaired++
+		}
+		// books are rebuilt from the repaired cache
+		books_mux.Lock()
+		books = make(map[string]*OrderBook)
+		books_mux.Unlock()
+		return
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return
+	}
+	for _, d := range diffs {
+		if d.toDB == nil {
+			skipped++
+			continue
+		}
+		if err = d.toDB(tx); err != nil {
+			tx.Rollback()
+			return 0, skipped, err
+		}
+		repaired++
+	}
+	err = tx.Commit()
+	return
+}
+
+// unionKeys returns every key of a and b, sorted.
+func unionKeys(a map[string]decimal.Decimal, b map[string]decimal.Decimal) (keys []string) {
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A connection that opens an order for an account, or sends <subscribe/> in
+// its transactions, is pushed an unsolicited <executed> report whenever one
+// of that account's resting orders fills, until it disconnects. Reports are
+// written in the encoding of the request that last subscribed it.
+var (
+	subscribers     = make(map[string]map[*Connection]wireFormat) // by account
+	subscribers_mux sync.Mutex
+)
+
+// subscribe pushes the account's fills to c from now on.
+func (c *Connection) subscribe(acctId string, format wireFormat) {
+	subscribers_mux.Lock()
+	defer subscribers_mux.Unlock()
+
+	if c.accounts[acctId] {
+		subscribers[acctId][c] = format
+		return
+	}
+	if c.accounts == nil {
+		c.accounts = make(map[string]bool)
+	}
+	c.accounts[acctId] = true
+
+	conns, ok := subscribers[acctId]
+	if !ok {
+		conns = make(map[*Connection]wireFormat)
+		subscribers[acctId] = conns
+	}
+	conns[c] = format
+
+	log.WithFields(log.Fields{
+		"account": acctId,
+		"remote":  c.conn.RemoteAddr(),
+	}).Info("Subscribed to execution reports")
+}
+
+// unsubscribe stops every report to c, once it has closed.
+func (c *Connection) unsubscribe() {
+	subscribers_mux.Lock()
+	defer subscribers_mux.Unlock()
+
+	for acctId := range c.accounts {
+		delete(subscribers[acctId], c)
+		if len(subscribers[acctId]) == 0 {
+			delete(subscribers, acctId)
+		}
+	}
+	c.accounts = nil
+}
+
+// A report of a resting order's fill, for the account's subscribers
+type executionReport struct {
+	account string
+	report  ExecutionReport
+}
+
+// reportingBatch is a batch together with what it owes to others: reports
+// of the fills of resting orders, and the market data of the books it
+// changed. Neither is sent until the batch is in the journal, as nothing
+// may be told to anyone before it would survive a crash.
+type reportingBatch struct {
+	Store
+	reports []executionReport
+	trades  map[string][]MarketDataTrade // by symbol, in the order they happened
+	updates []*MarketDataUpdate
+}
+
+func newReportingBatch() *reportingBatch {
+	return &reportingBatch{Store: SharedStore().beginBatch()}
+}
+
+// queueReport holds a report back until the batch has been journaled.
+func queueReport(m Store, acctId string, report ExecutionReport) {
+	if b, ok := m.(*reportingBatch); ok {
+		b.reports = append(b.reports, executionReport{account: acctId, report: report})
+	}
+}
+
+// publish sends everything the batch owes. Call it once the batch is in
+// the journal.
+func (b *reportingBatch) publish() {
+	publishReports(b.reports)
+	publishMarketData(b.updates)
+}
+
+// publishReports hands each report to its account's subscribers.
+func publishReports(reports []executionReport) {
+	if len(reports) == 0 {
+		return
+	}
+	subscribers_mux.Lock()
+	defer subscribers_mux.Unlock()
+
+	for _, r := range reports {
+		conns := subscribers[r.account]
+		if len(conns) == 0 {
+			continue
+		}
+		encoded := make(map[wireFormat][]byte)
+		for c, format := range conns {
+			if _, ok := encoded[format]; !ok {
+				encoded[format], _ = format.encode(r.report)
+			}
+			c.Push(encoded[format])
+		}
+	}
+}
@@ -1,559 +1,1293 @@
 package main
 
 import (
-	"bytes"
 	"encoding/xml"
 	"fmt"
-	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/farice/EME/decimal"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	counter_mux sync.Mutex
-	match_mux   sync.RWMutex // Mutex used to atomically match/execute orders
+	match_mux   sync.RWMutex // held shared by every request, exclusively by one that must lock everything
 )
 
 // Inc increments the counter for the given key.
 func IncAndGet() int {
 	counter_mux.Lock()
 	// Lock so only one goroutine at a time can access c.count
-	ct, _ := SharedModel().incTransactionCounter()
+	ct, _ := SharedStore().incTransactionCounter()
 	defer counter_mux.Unlock()
 	return ct
 }
 
 // must call with lock held to perform atomically
-func executeOrder(
-	matchAtBuyPrice bool,
-	// buy order info
-	b_trId string, b_acctId string, b_sym string, b_limit string, b_amount string,
-	// sell order info
-	s_trId string, s_acctId string, s_sym string, s_limit string, s_amount string) (sharesToExecute float64, err error) {
-
-	if b_sym != s_sym {
+// Trades sharesToExecute at price, which is always the limit of the resting
+// order. The buyer reserved cash at their own limit when the buy was opened;
+// the fill pays for the shares out of the balance and releases what was
+// reserved for them. A market buy reserves nothing (its limit is zero), so
+// it just pays.
+func executeOrder(m Store, book *OrderBook, price decimal.Decimal, sharesToExecute decimal.Decimal, buy *bookOrder, sell *bookOrder) (err error) {
+
+	if buy.sym != sell.sym {
 		err = fmt.Errorf("Symbol mismatch.")
 		return
 	}
 
 	log.Info("Execute order")
-	logAccount(b_acctId)
-	logAccount(s_acctId)
+	logAccount(buy.account)
+	logAccount(sell.account)
 
-	sym := b_sym
-	var limit_usd float64
-	if matchAtBuyPrice {
-		limit_usd, _ = strconv.ParseFloat(b_limit, 64)
-	} else {
-		limit_usd, _ = strconv.ParseFloat(s_limit, 64)
-	}
-	s_amt_f, _ := strconv.ParseFloat(s_amount, 64)
-	b_amt_f, _ := strconv.ParseFloat(b_amount, 64)
-	sharesToExecute = math.Min(-1*s_amt_f, b_amt_f)
+	sym := buy.sym
 
 	log.WithFields(log.Fields{
 		"sym":           sym,
-		"matched_limit": limit_usd,
-		"b_account_id":  b_acctId,
-		"b_limit":       b_limit,
-		"b_amount":      b_amount,
-		"s_account_id":  s_acctId,
-		"s_limit":       s_limit,
-		"s_amount":      s_amount,
+		"matched_limit": price,
+		"b_account_id":  buy.account,
+		"b_limit":       buy.limit,
+		"b_amount":      buy.amount,
+		"s_account_id":  sell.account,
+		"s_limit":       sell.limit,
+		"s_amount":      sell.amount.Neg(),
 	}).Info("Matched open orders")
 
 	// add shares to buyer's account (don't worry about seller, they had shares removed when order opened)
-	SharedModel().addOrSetSharesToPosition(b_acctId, sym, sharesToExecute)
+	m.addOrSetSharesToPosition(buy.account, sym, sharesToExecute)
 	// add money to seller's account
-	err = SharedModel().addAccountBalance(s_acctId, sharesToExecute*limit_usd)
+	err = m.addAccountBalance(sell.account, sharesToExecute.Mul(price))
 	if err != nil {
 		return
 	}
 
-	// remove money from buyer because money wasn't removed yet at order open
-	if !matchAtBuyPrice {
-		err = SharedModel().addAccountBalance(b_acctId, -1*sharesToExecute*limit_usd)
-		if err != nil {
-			return
-		}
+	// the buyer pays the trade price out of their reservation, which gives
+	// up the part it held for these shares
+	err = m.releaseFunds(buy.account, buy.release(sharesToExecute), sharesToExecute.Mul(price))
+	if err != nil {
+		return
 	}
 
+	sell.amount = sell.amount.Sub(sharesToExecute)
+	buy.amount = buy.amount.Sub(sharesToExecute)
+
 	exec_time := time.Now().String()
-	err = SharedModel().updateSellOrderAmount(s_trId, s_amt_f+sharesToExecute)
+	err = m.updateSellOrderAmount(sell.id, sell.amount.Neg())
 
 	if err != nil {
 		return
 	}
-	// Update in Executed shares list
-	err = SharedModel().executedOrder(s_trId, -1*sharesToExecute, limit_usd, exec_time)
+	_, err = m.recordTrade(buy.id, sell.id, buy.account, sell.account, sym, sharesToExecute, price, exec_time)
 	if err != nil {
 		return
 	}
-	err = SharedModel().updateBuyOrderAmount(b_trId, b_amt_f-sharesToExecute)
+	queueTrade(m, sym, MarketDataTrade{Shares: sharesToExecute, Price: price, Time: exec_time})
+
+	err = m.updateBuyOrderAmount(buy.id, buy.amount, buy.reserved)
 	if err != nil {
 		return
 	}
-	err = SharedModel().executedOrder(b_trId, sharesToExecute, limit_usd, exec_time)
 
-	if err != nil {
-		return
+	// add the fill to each order's history
+	for _, o := range []*bookOrder{buy, sell} {
+		event := eventPartial
+		if o.amount.IsZero() {
+			event = eventFill
+		}
+		traded, remaining := sharesToExecute, o.amount
+		if !o.buy {
+			traded, remaining = traded.Neg(), remaining.Neg()
+		}
+		m.recordOrderEvent(o.id, o.account, sym, event, traded, price, remaining, exec_time)
+
+		// the incoming order is answered in the response, a resting one's
+		// account only learns of the fill from a report
+		if _, resting := book.get(o.id); resting {
+			queueReport(m, o.account, ExecutionReport{TransactionID: o.id, Sym: sym, Shares: traded, Price: price, Remaining: remaining, Time: exec_time})
+		}
 	}
 
-	if s_amt_f+sharesToExecute == 0 {
-		err = SharedModel().closeOpenSellOrder(s_trId, sym)
+	if sell.amount.IsZero() {
+		book.remove(sell.id)
+		err = m.closeOpenSellOrder(sell.id, sym)
 	}
 
-	if b_amt_f-sharesToExecute == 0 {
-		err = SharedModel().closeOpenBuyOrder(b_trId, sym)
+	if buy.amount.IsZero() {
+		book.remove(buy.id)
+		err = m.closeOpenBuyOrder(buy.id, sym)
 	}
 
-	logAccount(b_acctId)
-	logAccount(s_acctId)
+	logAccount(buy.account)
+	logAccount(sell.account)
 
 	return
 
 }
 
-func (order *Order) handleBuy(acctId string, transId_str string, sym string, order_amt float64, limit_f float64) (err error) {
-	log.Info("Handle buy")
-	// check if user has enough USD in their account
-	var bal_float float64
-	// bal_float, err = getAccountBalance(acctId)
-	bal_float, err = SharedModel().getAccountBalance(acctId)
-	if err != nil {
-		return
-	}
+// Time in force: how long an order that doesn't fill right away stays in the book
+const (
+	tifGTC = "GTC" // good till canceled (default)
+	tifGTD = "GTD" // good till the order's expiry time
+	tifIOC = "IOC" // immediate or cancel: whatever doesn't fill now is canceled
+	tifFOK = "FOK" // fill or kill: fill completely now or not at all
+)
 
-	if order_amt*limit_f > bal_float {
-		err = fmt.Errorf("Insufficient funds")
-		return
+// Outcome of an order, reported as its status
+const (
+	statusFilled   = "filled"   // executed completely
+	statusOpen     = "open"     // the unfilled part rests in the book
+	statusCanceled = "canceled" // the unfilled part was canceled
+	statusKilled   = "killed"   // FOK could not fill, nothing executed
+)
+
+// Self-trade prevention: what happens when an order would trade with a
+// resting order from the same account
+const (
+	stpNone           = "none"            // let it trade (default)
+	stpCancelResting  = "cancel-resting"  // cancel the resting order and keep matching
+	stpCancelIncoming = "cancel-incoming" // cancel what is left of the incoming order
+	stpCancelBoth     = "cancel-both"     // cancel both
+	stpDecrement      = "decrement"       // take the smaller size off both, canceling whichever is used up
+)
+
+// validSelfTradePrevention reports whether stp names a mode; "" means
+// the account's default.
+func validSelfTradePrevention(stp string) bool {
+	switch stp {
+	case "", stpNone, stpCancelResting, stpCancelIncoming, stpCancelBoth, stpDecrement:
+		return true
 	}
+	return false
+}
 
-	log.WithFields(log.Fields{
-		"transId":          transId_str,
-		"buy amount (USD)": order_amt * limit_f,
-		"balance":          bal_float,
-	}).Info("Funds")
+// How an order should be handled beyond its side, size and limit
+type orderOptions struct {
+	market  bool
+	tif     string
+	expires time.Time // GTD only
+	stp     string
+}
 
-	err = SharedModel().createOrder(transId_str, acctId, sym, order.Limit, order.Amount, time.Now())
+// rests reports whether the unfilled part of the order joins the book.
+func (opts orderOptions) rests() bool {
+	return !opts.market && (opts.tif == tifGTC || opts.tif == tifGTD)
+}
 
-	if err != nil {
-		return
+// Shares of an order canceled to prevent a self-trade
+type selfTrade struct {
+	id       string
+	canceled decimal.Decimal // negative for sells
+}
+
+// Result of opening an order
+type orderOutcome struct {
+	status     string
+	canceled   decimal.Decimal // shares that did not fill and will not rest
+	selfTrades []selfTrade
+}
+
+// crosses reports whether incoming is priced to trade against resting.
+func crosses(incoming *bookOrder, resting *bookOrder) bool {
+	if incoming.buy {
+		return resting.limit.Cmp(incoming.limit) <= 0
 	}
-	// get open sell with lowest sell value
-	var members []string
+	return resting.limit.Cmp(incoming.limit) >= 0
+}
 
-	match_mux.Lock()
-	defer match_mux.Unlock() // in case exception is thrown, unlock when stack closes
+// fillable reports whether the book holds enough crossing liquidity to fill
+// incoming completely. A market buy must also be able to pay for it out of budget.
+func fillable(book *OrderBook, incoming *bookOrder, opts orderOptions, budget decimal.Decimal) bool {
+	needed := incoming.amount
+	for _, level := range book.levels(!incoming.buy) {
+		for _, resting := range level.orders {
+			if !opts.market && !crosses(incoming, resting) {
+				return false
+			}
+			// the account's own orders never trade with it, and only
+			// cancel-resting leaves all of incoming to trade with the rest
+			if opts.stp != stpNone && resting.account == incoming.account {
+				if opts.stp == stpCancelResting {
+					continue
+				}
+				return false
+			}
+			shares := decimal.Min(needed, resting.amount)
+			if opts.market && incoming.buy {
+				shares = affordableShares(shares, resting.limit, budget)
+				budget = budget.Sub(shares.Mul(resting.limit))
+				if shares.Cmp(decimal.Min(needed, resting.amount)) < 0 {
+					return false
+				}
+			}
+			needed = needed.Sub(shares)
+			if needed.Sign() <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchIncoming trades incoming against the other side of the book, best
+// price first, until it fills, the book stops crossing, or a market buy
+// runs out of budget. If it meets a resting order of its own account,
+// opts.stp decides what is canceled instead; stopped means what is left of
+// incoming must be canceled rather than rest. must call with lock held.
+func matchIncoming(m Store, book *OrderBook, incoming *bookOrder, opts orderOptions, budget decimal.Decimal) (selfTrades []selfTrade, stopped bool, err error) {
+	for incoming.amount.Sign() > 0 {
+		resting := book.best(!incoming.buy)
+		if resting == nil {
+			log.Info("No resting orders to match")
+			break
+		}
+
+		log.WithFields(log.Fields{
+			"transId": resting.id,
+			"account": resting.account,
+			"limit":   resting.limit,
+			"amount":  resting.amount,
+		}).Info("Found best resting order")
+
+		if !opts.market && !crosses(incoming, resting) {
+			log.Info("Price incompatible")
+			break
+		}
+
+		if opts.stp != stpNone && resting.account == incoming.account {
+			var canceled []selfTrade
+			canceled, stopped, err = preventSelfTrade(m, book, opts, incoming, resting)
+			selfTrades = append(selfTrades, canceled...)
+			if err != nil || stopped {
+				return
+			}
+			continue
+		}
 
-	var amountUnexecuted = order_amt
+		shares := decimal.Min(incoming.amount, resting.amount)
+		if opts.market && incoming.buy {
+			shares = affordableShares(shares, resting.limit, budget)
+			if shares.Sign() <= 0 {
+				log.Info("Balance exhausted")
+				break
+			}
+			budget = budget.Sub(shares.Mul(resting.limit))
+		}
 
-	// loop until there are no more orders to execute
-	getMin:
-	for {
-		members, err = SharedModel().getMinimumSellOrder(sym, limit_f)
+		if incoming.buy {
+			err = executeOrder(m, book, resting.limit, shares, incoming, resting)
+		} else {
+			err = executeOrder(m, book, resting.limit, shares, resting, incoming)
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
-				"err":      err,
+				"err": err,
 			}).Error("couldn't match")
 			return
 		}
-		log.WithFields(log.Fields{
-			"members": members,
-		}).Info("Found minimum sell order")
-
-		if len(members) > 0 {
-			// get information on this matched order...
-			// "account", "symbol", "limit", "amount", "origAmount"
-			data, _ := SharedModel().getOrder(members[0])
+	}
+	return
+}
 
-			log.WithFields(log.Fields{
-				"fields": "\"account\", \"symbol\", \"limit\", \"amount\", \"origAmount\"",
-				"data":      data,
-				"len(data)": len(data),
-			}).Info("Matched Order Info")
+// preventSelfTrade applies opts.stp to incoming meeting resting, an order
+// from the same account, and returns the shares it canceled on the resting
+// side, and on the incoming side when it was decremented. stopped means the
+// rest of incoming is to be canceled by the caller.
+func preventSelfTrade(m Store, book *OrderBook, opts orderOptions, incoming *bookOrder, resting *bookOrder) (canceled []selfTrade, stopped bool, err error) {
+	log.WithFields(log.Fields{
+		"incoming": incoming.id,
+		"resting":  resting.id,
+		"account":  incoming.account,
+		"stp":      opts.stp,
+	}).Info("Preventing self-trade")
+
+	shares := resting.amount
+	if opts.stp == stpDecrement {
+		shares = decimal.Min(incoming.amount, resting.amount)
+	}
 
-			if len(data) != 5 {
-				err = fmt.Errorf("Corrupted data: matched order info")
+	switch opts.stp {
+	case stpCancelIncoming:
+		return nil, true, nil
+	case stpCancelResting, stpCancelBoth:
+		if _, err = cancelOpenOrder(m, resting.id, eventSelfTrade); err != nil {
+			return
+		}
+	case stpDecrement:
+		if shares.Cmp(resting.amount) == 0 {
+			if _, err = cancelOpenOrder(m, resting.id, eventSelfTrade); err != nil {
 				return
 			}
+		} else if err = decrementOrder(m, resting, shares); err != nil {
+			return
+		}
+		// whatever of incoming is left keeps matching
+		if err = decrementOrder(m, incoming, shares); err != nil {
+			return
+		}
+		canceled = append(canceled, selfTrade{id: incoming.id, canceled: signed(shares, incoming.buy)})
+		stopped = incoming.amount.IsZero()
+	}
+	canceled = append([]selfTrade{{id: resting.id, canceled: signed(shares, resting.buy)}}, canceled...)
+	stopped = stopped || opts.stp == stpCancelBoth
+	return
+}
 
-			matched_limit_f, _ := strconv.ParseFloat(data[2], 64)
-			if matched_limit_f < limit_f {
-				var amountExecuted float64
-				amountExecuted, err = executeOrder(false, transId_str, acctId, sym, order.Limit, order.Amount, members[0], data[0], data[1], data[2], data[3])
-				amountUnexecuted -= amountExecuted
-				if amountUnexecuted == 0 {
-					log.Error("Fully executed")
-					break getMin
-				}
+// selfTraded adds up the shares of order id that self-trade prevention
+// canceled.
+func selfTraded(selfTrades []selfTrade, id string) (shares decimal.Decimal) {
+	for _, st := range selfTrades {
+		if st.id == id {
+			shares = shares.Add(st.canceled.Abs())
+		}
+	}
+	return
+}
 
-			} else {
-				log.Error("Price incompatible")
-				break getMin
-			}
+// decrementOrder cancels shares of an order that keeps the rest, returning
+// the cash or shares they held.
+func decrementOrder(m Store, o *bookOrder, shares decimal.Decimal) (err error) {
+	if o.buy {
+		err = m.releaseFunds(o.account, o.release(shares), decimal.Zero)
+	} else {
+		err = m.addSharesToPosition(o.account, o.sym, shares)
+	}
+	if err != nil {
+		return
+	}
+	o.amount = o.amount.Sub(shares)
+	if o.buy {
+		err = m.updateBuyOrderAmount(o.id, o.amount, o.reserved)
+	} else {
+		err = m.updateSellOrderAmount(o.id, o.amount.Neg())
+	}
+	if err != nil {
+		return
+	}
+	m.recordOrderEvent(o.id, o.account, o.sym, eventSelfTrade, signed(shares, o.buy), decimal.Zero, signed(o.amount, o.buy), time.Now().String())
+	return
+}
 
-		} else {
-			log.Error("No minimum sells")
-			break getMin
+// signed gives shares the sign of the order's side, negative for sells.
+func signed(shares decimal.Decimal, buy bool) decimal.Decimal {
+	if buy {
+		return shares
+	}
+	return shares.Neg()
+}
+
+// affordableShares caps shares at the most that budget can pay for at price.
+func affordableShares(shares decimal.Decimal, price decimal.Decimal, budget decimal.Decimal) decimal.Decimal {
+	if shares.Mul(price).Cmp(budget) <= 0 {
+		return shares
+	}
+	shares = budget.Div(price)
+	// Mul rounds, so the quotient can still cost a unit more than budget
+	for shares.Sign() > 0 && shares.Mul(price).Cmp(budget) > 0 {
+		shares = shares.Sub(decimal.FromUnits(1))
+	}
+	return shares
+}
+
+func (order *Order) handleBuy(m Store, acctId string, transId_str string, sym string, order_amt decimal.Decimal, limit decimal.Decimal, opts orderOptions) (outcome orderOutcome, err error) {
+	log.Info("Handle buy")
+	// only cash not already reserved by the account's resting buys can be spent
+	bal, reserved, err := m.getAccountFunds(acctId)
+	if err != nil {
+		return
+	}
+	available := bal.Sub(reserved)
+
+	// a market order has no limit, so it may spend up to everything available
+	cost, ok := order_amt.CheckedMul(limit)
+	if !ok || (!opts.market && cost.Sign() <= 0) {
+		err = fmt.Errorf("Order value out of range")
+		return
+	}
+	if opts.market && available.Sign() <= 0 {
+		err = fmt.Errorf("Insufficient funds")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"transId":          transId_str,
+		"buy amount (USD)": cost,
+		"balance":          bal,
+		"reserved":         reserved,
+		"market":           opts.market,
+		"tif":              opts.tif,
+	}).Info("Funds")
+
+	// reserve the whole order at our limit, checking and taking it in one step
+	if !opts.market {
+		err = m.reserveFunds(acctId, cost)
+		if err != nil {
+			return
 		}
 	}
 
+	err = m.createOrder(transId_str, acctId, sym, limit, order_amt, time.Now())
+
+	if err != nil {
+		m.releaseFunds(acctId, cost, decimal.Zero)
+		return
+	}
+
+	book := getBook(sym)
+	incoming := &bookOrder{id: transId_str, account: acctId, sym: sym, buy: true, limit: limit, amount: order_amt}
+	if !opts.market {
+		incoming.reserved = cost
+	}
+
+	if opts.tif == tifFOK && !fillable(book, incoming, opts, available) {
+		outcome = orderOutcome{status: statusKilled, canceled: order_amt}
+		m.releaseFunds(acctId, cost, decimal.Zero)
+		err = cancelUnfilled(m, transId_str, acctId, sym, order_amt, eventCancel)
+		return
+	}
+
+	selfTrades, stopped, err := matchIncoming(m, book, incoming, opts, available)
+	outcome.selfTrades = selfTrades
+	if err != nil {
+		return
+	}
+
 	log.WithFields(log.Fields{
-		"Amount Unexecuted": amountUnexecuted,
+		"Amount Unexecuted": incoming.amount,
 	}).Info("Status")
 
-	if amountUnexecuted > 0 {
+	if incoming.amount.IsZero() {
+		outcome.status = statusFilled
+		if stopped {
+			// decremented away by its own account's orders
+			outcome.status = statusCanceled
+			outcome.canceled = selfTraded(outcome.selfTrades, transId_str)
+		}
+	} else if !opts.rests() || stopped {
+		// release what the unfilled shares reserved, then cancel them
+		outcome.status, outcome.canceled = statusCanceled, incoming.amount
+		m.releaseFunds(acctId, incoming.release(incoming.amount), decimal.Zero)
+		event := eventCancel
+		if stopped {
+			event = eventSelfTrade
+			outcome.selfTrades = append(outcome.selfTrades, selfTrade{id: transId_str, canceled: incoming.amount})
+		}
+		err = cancelUnfilled(m, transId_str, acctId, sym, incoming.amount, event)
+		return
+	} else {
 		// No matches, add to open buy sorted set
-		SharedModel().createBuyOrder(transId_str, acctId, sym, amountUnexecuted, order.Limit, limit_f)
+		outcome.status = statusOpen
+		book.add(incoming)
+		err = m.createBuyOrder(transId_str, acctId, sym, incoming.amount, limit, incoming.reserved, incoming.seq)
 		if err != nil {
+			book.remove(transId_str)
+			// release the reservation for the shares that could not rest
+			m.releaseFunds(acctId, incoming.release(incoming.amount), decimal.Zero)
 			return
 		}
-
-		// remove funds from account, because not all was matched immediately
-		SharedModel().addAccountBalance(acctId, -1*amountUnexecuted*limit_f)
+		if opts.tif == tifGTD {
+			err = m.setOrderExpiry(transId_str, true, opts.expires)
+		}
 	}
 
 	logAccount(acctId)
 	return
 }
 
-func (order *Order) handleSell(acctId string, transId_str string, sym string, order_amt float64, limit_f float64) (err error) {
+func (order *Order) handleSell(m Store, acctId string, transId_str string, sym string, order_amt decimal.Decimal, limit decimal.Decimal, opts orderOptions) (outcome orderOutcome, err error) {
 	log.Info("handle sell")
 	// check if user has enough of SYM in their account
-	so_float, err := SharedModel().getPositionAmount(acctId, sym)
+	owned, err := m.getPositionAmount(acctId, sym)
 	if err != nil {
 		return
 	}
 
-	if -1*order_amt > so_float {
+	// a market sell offers no more than the position it can deliver
+	offered := order_amt.Neg()
+	if opts.market && offered.Cmp(owned) > 0 {
+		offered = owned
+	}
+
+	if offered.Cmp(owned) > 0 || offered.Sign() <= 0 {
 		err = fmt.Errorf("Insufficient funds")
 		return
 	}
+	// the proceeds of a limit sell must be representable, as a buy's cost is
+	if proceeds, ok := offered.CheckedMul(limit); !ok || (!opts.market && proceeds.Sign() <= 0) {
+		err = fmt.Errorf("Order value out of range")
+		return
+	}
 
 	log.WithFields(log.Fields{
 		"transId":      transId_str,
-		"sell amount":  -1 * order_amt,
-		"shares owned": so_float,
+		"sell amount":  order_amt.Neg(),
+		"shares owned": owned,
+		"market":       opts.market,
+		"tif":          opts.tif,
 	}).Info("Holdings")
 	logAccount(acctId)
 
 	// set order details
-	err = SharedModel().createOrder(transId_str, acctId, sym, order.Limit, order.Amount, time.Now())
+	err = m.createOrder(transId_str, acctId, sym, limit, order_amt, time.Now())
 
 	if err != nil {
 		return
 	}
 
-	var members []string
-	match_mux.Lock()
-	defer match_mux.Unlock() // in case exception is thrown, unlock when stack closes
-
-	// remove shares from user's account
-	SharedModel().addSharesToPosition(acctId, sym, order_amt)
-
-	var sharesRemaining = order_amt // shares left to sell (<= 0)
+	book := getBook(sym)
+	incoming := &bookOrder{id: transId_str, account: acctId, sym: sym, buy: false, limit: limit, amount: offered}
 
-getMax:
-	for {
-
-		// find highest open buy order
-		members, err = SharedModel().getMaximumBuyOrder(sym, limit_f)
-		if err != nil {
-			return
-		}
-
-		log.WithFields(log.Fields{
-			"members": members,
-		}).Info("Found maximum order")
-
-		if len(members) > 0 {
-			// get information on this matched order...
-			data, _ := SharedModel().getOrder(members[0])
-
-			log.WithFields(log.Fields{
-				"fields": "\"account\", \"symbol\", \"limit\", \"amount\", \"origAmount\"",
-				"data":      data,
-				"len(data)": len(data),
-			}).Info("Matched Order Info")
+	// a market sell capped at the position can't fill the whole order either
+	if opts.tif == tifFOK && (offered.Cmp(order_amt.Neg()) < 0 || !fillable(book, incoming, opts, decimal.Zero)) {
+		outcome = orderOutcome{status: statusKilled, canceled: order_amt.Neg()}
+		err = cancelUnfilled(m, transId_str, acctId, sym, order_amt, eventCancel)
+		return
+	}
 
-			if len(data) != 5 {
-				err = fmt.Errorf("Corrupted data: matched order info")
-				return
-			}
+	// remove shares from user's account
+	m.addSharesToPosition(acctId, sym, offered.Neg())
 
-			matched_limit_f, _ := strconv.ParseFloat(data[2], 64)
-			// price is executable
-			if matched_limit_f > limit_f {
-				// <=0
-				var amountExecuted float64
-				amountExecuted, err = executeOrder(true, members[0], data[0], data[1], data[2], data[3], transId_str, acctId, sym, order.Limit, order.Amount)
-				sharesRemaining += amountExecuted
-				if sharesRemaining == 0 {
-					break getMax
-				}
-			} else {
-				break getMax
-			}
-		} else {
-			break getMax
-		}
+	selfTrades, stopped, err := matchIncoming(m, book, incoming, opts, decimal.Zero)
+	outcome.selfTrades = selfTrades
+	if err != nil {
+		return
 	}
 
 	log.WithFields(log.Fields{
-		"Amount Unexecuted": sharesRemaining,
+		"Amount Unexecuted": incoming.amount.Neg(),
 	}).Info("Status")
 
-	// more shares to sell, still
-	if sharesRemaining < 0 {
+	// shares a market sell asked for beyond its position never entered the book
+	unfilled := incoming.amount.Add(order_amt.Neg().Sub(offered))
+
+	if unfilled.IsZero() {
+		outcome.status = statusFilled
+		if stopped {
+			// decremented away by its own account's orders
+			outcome.status = statusCanceled
+			outcome.canceled = selfTraded(outcome.selfTrades, transId_str)
+		}
+	} else if !opts.rests() || stopped {
+		// return what we took and cancel everything unfilled
+		outcome.status, outcome.canceled = statusCanceled, unfilled
+		if incoming.amount.Sign() > 0 {
+			m.addSharesToPosition(acctId, sym, incoming.amount)
+		}
+		event := eventCancel
+		if stopped {
+			event = eventSelfTrade
+			outcome.selfTrades = append(outcome.selfTrades, selfTrade{id: transId_str, canceled: unfilled.Neg()})
+		}
+		err = cancelUnfilled(m, transId_str, acctId, sym, unfilled.Neg(), event)
+		return
+	} else {
 		// No matches, add to open sell sorted set
-		err = SharedModel().createSellOrder(transId_str, acctId, sym, sharesRemaining, order.Limit, limit_f)
+		outcome.status = statusOpen
+		book.add(incoming)
+		err = m.createSellOrder(transId_str, acctId, sym, incoming.amount.Neg(), limit, incoming.seq)
 		if err != nil {
+			book.remove(transId_str)
 			return
 		}
-
+		if opts.tif == tifGTD {
+			err = m.setOrderExpiry(transId_str, false, opts.expires)
+		}
 	}
 	logAccount(acctId)
 
 	return
 }
 
-func getOrderStatus(trId string) (resp string, err error) {
+// cancelUnfilled records that the unfilled part of an order that never
+// rested was canceled (amount is negative for sells), as event. Any cash or
+// shares the order held must already have been returned.
+func cancelUnfilled(m Store, trId string, acctId string, sym string, amount decimal.Decimal, event string) (err error) {
+	if amount.Sign() > 0 {
+		err = m.updateBuyOrderAmount(trId, decimal.Zero, decimal.Zero)
+	} else {
+		err = m.updateSellOrderAmount(trId, decimal.Zero)
+	}
+	if err != nil {
+		return
+	}
+	return m.cancelOrder(trId, acctId, sym, amount, event, time.Now().String())
+}
+
+// getOrderStatus reports an order's fills, what is still open and any
+// cancel, entirely from the order's history, which includes whatever the
+// request has done to it so far.
+func getOrderStatus(m Store, trId string) (resp elements, err error) {
 	log.Info("Get order status")
-	ex, _ := SharedModel().transactionExists(trId)
-	if !ex {
-		resp = ""
+	events, err := m.getOrderEvents(trId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"transId": trId,
+			"error":   err,
+		}).Error("Failed to read order history")
+		return
+	}
+	if len(events) == 0 {
 		err = fmt.Errorf("Transaction does not exist")
 		return
 	}
-
-	// "account", "symbol", "limit", "amount", "origAmount"
-	order_info, _ := SharedModel().getOrder(trId)
 	log.WithFields(log.Fields{
-		"order info: [acct, sym, lim, amt, o_amt]": order_info,
-	}).Info("Status transaction")
+		"events": events,
+	}).Info("Order history")
+
+	var remaining decimal.Decimal
+	var canceled *CancelQueryResponse
+	for _, e := range events {
+		switch e.event {
+		case eventPartial, eventFill:
+			resp = append(resp, ExecutedQueryResponse{Shares: e.amount, Price: e.price, Time: e.time})
+		case eventCancel:
+			canceled = &CancelQueryResponse{Shares: e.amount, Time: e.time}
+		case eventSelfTrade:
+			// each is reported, since an order can lose shares to several
+			resp = append(resp, CancelQueryResponse{Shares: e.amount, Time: e.time, Reason: "self-trade"})
+		}
+		remaining = e.remaining
+	}
 
-	transactions, _ := getPartialExecutions(trId)
-	log.WithFields(log.Fields{
-		"Transactions": transactions,
-	}).Info("Execution history")
+	if !remaining.IsZero() {
+		resp = append(resp, OpenQueryResponse{Shares: remaining})
+	} else if canceled != nil {
+		resp = append(resp, *canceled)
+	}
+
+	return
+}
 
-	if len(transactions)%3 != 0 {
-		resp = ""
-		err = fmt.Errorf("Malformed Redis Data")
+// handleBook adds up the open orders of a symbol by price, best first, up
+// to the requested number of levels a side. It reads the in-memory book,
+// which is loaded from the open-buy:/open-sell: sets and order: amounts and
+// kept in step with them by every match.
+func (b *Book) handleBook(m Store) (resp BookResponse, err error) {
+	log.Info("handle book")
+	if b.Sym == "" {
+		err = fmt.Errorf("Symbol is required")
 		return
 	}
-
-	len_trans := len(transactions) / 3
-	for i := 0; i < len_trans; i++ {
-		exec := ExecutedQueryResponse{Shares: transactions[3*i], Price: transactions[3*i+1], Time: transactions[3*i+2]}
-		if exec_string, err := xml.MarshalIndent(exec, "", "    "); err == nil {
-			resp += string(exec_string) + "\n"
+	depth := -1 // every level
+	if b.Depth != "" {
+		depth, err = strconv.Atoi(string(b.Depth))
+		if err != nil || depth < 1 {
+			err = fmt.Errorf("Depth must be a positive whole number")
+			return
 		}
 	}
 
-	remaining_amount, _ := strconv.ParseFloat(order_info[3], 64)
-	if remaining_amount != 0 {
-		open := OpenQueryResponse{Shares: order_info[3]}
-		if open_string, err := xml.MarshalIndent(open, "", "    "); err == nil {
-			resp += string(open_string) + "\n"
+	book := getBook(b.Sym)
+	resp = BookResponse{Sym: b.Sym}
+	for _, side := range []bool{true, false} {
+		name := "ask"
+		if side {
+			name = "bid"
 		}
-	} else { // may have been cancelled!
-		ex, _ := SharedModel().orderCancelled(trId)
-		if ex {
-			cancel_info, _ := SharedModel().getCancelledOrderDetails(trId)
-			cancel := CancelQueryResponse{Shares: cancel_info[0], Time: cancel_info[1]}
-			if cancel_string, err := xml.MarshalIndent(cancel, "", "    "); err == nil {
-				resp += string(cancel_string) + "\n"
-			}
+		levels := book.depth(side)
+		if depth >= 0 && len(levels) > depth {
+			levels = levels[:depth]
 		}
+		for _, level := range levels {
+			resp.Levels = append(resp.Levels, MarketDataLevel{XMLName: xml.Name{Local: name}, Price: level.price, Shares: level.shares, Orders: level.orders})
+		}
+	}
+	return
+}
+
+func handleBalance(m Store, acctId string) (resp BalanceResponse, err error) {
+	log.Info("handle balance")
+	balance, reserved, err := m.getAccountFunds(acctId)
+	if err != nil {
+		return
+	}
+	resp = BalanceResponse{Total: balance, Available: balance.Sub(reserved), Reserved: reserved}
+	return
+}
+
+// handlePositions lists the account's positions by symbol, as the request
+// has left them so far.
+func handlePositions(m Store, acctId string) (resp PositionsResponse, err error) {
+	log.Info("handle positions")
+	if exists, _ := m.accountExists(acctId); !exists {
+		err = fmt.Errorf("Account does not exist")
+		return
+	}
+
+	positions, err := m.getPositions(acctId)
+	if err != nil {
+		return
+	}
+	syms := make([]string, 0, len(positions))
+	for sym := range positions {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	for _, sym := range syms {
+		resp.Positions = append(resp.Positions, PositionResponse{Sym: sym, Shares: positions[sym]})
+	}
+	return
+}
+
+// handleOrders lists the account's orders, oldest first, each with its
+// status worked out from its history the way a query does. status "open"
+// leaves out those that are done.
+func (o *Orders) handleOrders(m Store, acctId string) (resp OrdersResponse, err error) {
+	log.Info("handle orders")
+	status := o.Status
+	if status == "" {
+		status = statusOpen
+	}
+	if status != statusOpen && status != "all" {
+		err = fmt.Errorf("Status must be open or all")
+		return
+	}
+	if exists, _ := m.accountExists(acctId); !exists {
+		err = fmt.Errorf("Account does not exist")
+		return
 	}
 
-	logAccount(order_info[0])
+	orders, err := m.getAccountOrders(acctId)
+	if err != nil {
+		return
+	}
+	resp.Status = status
+	for _, order := range orders {
+		var events []orderEvent
+		events, err = m.getOrderEvents(order.id)
+		if err != nil {
+			return
+		}
+		limit := order.limit
+		canceled := false
+		var remaining decimal.Decimal
+		for _, e := range events {
+			switch e.event {
+			case eventReplace:
+				limit = e.price
+			case eventCancel, eventSelfTrade:
+				canceled = true
+			}
+			remaining = e.remaining
+		}
 
+		r := OrderResponse{TransactionID: order.id, Sym: order.symbol, Amount: order.amount, Remaining: remaining, Status: statusFilled}
+		if !limit.IsZero() {
+			r.Limit = &limit
+		}
+		if !remaining.IsZero() {
+			r.Status = statusOpen
+		} else if canceled {
+			r.Status = statusCanceled
+		}
+		if status == statusOpen && r.Status != statusOpen {
+			continue
+		}
+		resp.Orders = append(resp.Orders, r)
+	}
 	return
 }
 
-func (q *Query) handleQuery() (resp string, err error) {
+func (q *Query) handleQuery(m Store) (resp StatusResponse, err error) {
 	log.Info("handle query")
-	resp += "<status>\n"
 
 	trId := q.TransactionID
 	if trId == "" {
 		err = fmt.Errorf("Invalid Query")
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</status>"
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
 		return
 	}
 
-	// Read lock (allows concurrent queries)
-	match_mux.RLock()
-	defer match_mux.RUnlock()
-
-	status, err := getOrderStatus(trId)
+	status, err := getOrderStatus(m, trId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("Error")
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</status>"
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
 		return
 	}
-	resp += status
-
-	resp += "</status>"
+	resp.Items = status
 
 	return
 }
 
-func cancelQueryErrorMessage(trId string, reason string) (resp string) {
-	fail := ErrorQueryCancelResponse{TransactionID: trId, Reason: reason}
-		if fail_string, err := xml.MarshalIndent(fail, "", "    "); err == nil {
-			resp = string(fail_string) + "\n"
-		}
-		return
+func cancelQueryError(trId string, reason string) ErrorQueryCancelResponse {
+	return ErrorQueryCancelResponse{TransactionID: trId, Reason: reason}
 }
 
-func (c *Cancel) handleCancel() (resp string, err error) {
+func (c *Cancel) handleCancel(m Store) (resp CancelResponse, err error) {
 	log.Info("handle cancel")
-	resp += "<canceled>\n"
 
 	trId := c.TransactionID
 	if trId == "" {
 		err = fmt.Errorf("Invalid Query")
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</canceled>"
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
 		return
 	}
 
-
-	match_mux.Lock()
-	defer match_mux.Unlock()
-
-	ex, _ := SharedModel().transactionExists(trId)
+	ex, _ := m.transactionExists(trId)
 	if !ex {
 		err = fmt.Errorf("Transaction does not exist")
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</canceled>"
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
 		return
 	}
 
-	// "account", "symbol", "limit", "amount"
-	data, err := SharedModel().getOrder(trId)
-	acct, sym, limit, amt := data[0], data[1], data[2], data[3]
+	acct, err := cancelOpenOrder(m, trId, eventCancel)
 	if err != nil {
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</canceled>"
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
 		return
 	}
 
-	log.WithFields(log.Fields{
-		"order info: [acct, sym, lim, amt, o_amt]": data,
-	}).Info("Cancelling order")
-	logAccount(acct)
+	status, err := getOrderStatus(m, trId)
+	if err != nil {
+		resp.Items = elements{cancelQueryError(trId, err.Error())}
+		return
+	}
+	resp.Items = status
+
+	if acct != "" {
+		logAccount(acct)
+	}
+	return
+}
+
+// handleReplace changes the size and/or limit of a resting order in place.
+// Shrinking an order keeps its place in the queue; any other change sends it
+// to the back of its (possibly new) price level, and a new limit that crosses
+// the book trades straight away. The cash or shares the order holds are
+// adjusted under the same lock, so it is never out of the book.
+func (r *Replace) handleReplace(m Store, acctId string) (resp ReplacedResponse, err error) {
+	log.Info("handle replace")
+	trId := r.TransactionID
+	if trId == "" {
+		err = fmt.Errorf("Invalid Query")
+		return
+	}
 
-	if len(data) != 5 {
-		err = fmt.Errorf("Malformed redis data")
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</canceled>"
+	data, err := m.getOrder(trId)
+	if err != nil {
+		err = fmt.Errorf("Transaction does not exist")
+		return
+	}
+	if data.account != acctId {
+		err = fmt.Errorf("Transaction belongs to another account")
+		return
+	}
+	sym := data.symbol
+	book := getBook(sym)
+	o, ok := book.get(trId)
+	if !ok || data.amount.IsZero() {
+		err = fmt.Errorf("Order is not open")
 		return
 	}
+	buy := o.buy
 
-	amt_f, _ := strconv.ParseFloat(amt, 64)
-	buy := (amt_f > 0)
+	newAmount, newLimit := data.amount, data.limit
+	if r.Amount != nil {
+		newAmount = *r.Amount
+	}
+	if r.Limit != nil {
+		newLimit = *r.Limit
+	}
+	if newAmount.Sign() != data.amount.Sign() {
+		err = fmt.Errorf("Invalid amount")
+		return
+	}
+	if newLimit.Sign() <= 0 {
+		err = fmt.Errorf("Invalid limit")
+		return
+	}
 
-	if amt_f != 0 {
+	remaining, newRemaining := o.amount, newAmount.Abs()
+	keep := newLimit.Cmp(o.limit) == 0 && newRemaining.Cmp(remaining) <= 0
+	if value, ok := newRemaining.CheckedMul(newLimit); !ok || value.Sign() <= 0 {
+		err = fmt.Errorf("Order value out of range")
+		return
+	}
 
-		// remove from open orders sorted set
-		if buy {
-			err = SharedModel().closeOpenBuyOrder(trId, sym)
-		} else {
-			err = SharedModel().closeOpenSellOrder(trId, sym)
+	// move the difference in reserved cash or shares in or out of the account
+	var reservation decimal.Decimal
+	if buy {
+		reservation = newRemaining.Mul(newLimit)
+		delta := reservation.Sub(o.reserved)
+		if delta.Sign() > 0 {
+			err = m.reserveFunds(acctId, delta)
+		} else if delta.Sign() < 0 {
+			err = m.releaseFunds(acctId, delta.Neg(), decimal.Zero)
 		}
-
-		if err != nil {
-			resp += cancelQueryErrorMessage(trId, err.Error())
-			resp += "</canceled>"
-			return
+	} else {
+		delta := newRemaining.Sub(remaining)
+		if delta.Sign() > 0 {
+			var owned decimal.Decimal
+			owned, err = m.getPositionAmount(acctId, sym)
+			if err != nil {
+				return
+			}
+			if delta.Cmp(owned) > 0 {
+				err = fmt.Errorf("Insufficient funds")
+				return
+			}
 		}
+		if !delta.IsZero() {
+			err = m.addSharesToPosition(acctId, sym, delta.Neg())
+		}
+	}
+	if err != nil {
+		return
+	}
+	o.reserved = reservation
 
-		if buy { // add money back to account if buy order
-			limit_f, _ := strconv.ParseFloat(limit, 64)
-			SharedModel().addAccountBalance(acct, limit_f*amt_f)
+	resp = ReplacedResponse{TransactionID: trId, Sym: sym, Limit: newLimit, Priority: "kept"}
 
-		} else { // add shares back to account if sell order
-			SharedModel().addOrSetSharesToPosition(acct, sym, -1*amt_f)
-		}
+	// recorded before any trades the new limit causes, which follow it
+	amended := newRemaining
+	if !buy {
+		amended = amended.Neg()
+	}
+	m.recordOrderEvent(trId, acctId, sym, eventReplace, amended, newLimit, amended, time.Now().String())
 
-		// set remaining amount to 0
+	if keep {
+		o.amount = newRemaining
 		if buy {
-			err = SharedModel().updateBuyOrderAmount(trId, 0.0)
+			err = m.updateBuyOrderAmount(trId, o.amount, o.reserved)
 		} else {
-			err = SharedModel().updateSellOrderAmount(trId, 0.0)
+			err = m.updateSellOrderAmount(trId, o.amount.Neg())
 		}
-
+	} else {
+		// re-enter the order as if it had just arrived
+		resp.Priority = "lost"
+		book.remove(trId)
+		o.limit, o.amount, o.seq = newLimit, newRemaining, 0
+
+		// an amended order follows its account's self-trade prevention
+		opts := orderOptions{tif: tifGTC}
+		opts.stp, err = accountSelfTradePrevention(m, acctId)
 		if err != nil {
-			resp += cancelQueryErrorMessage(trId, err.Error())
-			resp += "</canceled>"
 			return
 		}
-
-		// store info
-		exec_time := time.Now().String()
-		err = SharedModel().cancelOrder(trId, amt_f, exec_time)
+		var selfTrades []selfTrade
+		var stopped bool
+		selfTrades, stopped, err = matchIncoming(m, book, o, opts, decimal.Zero)
+		resp.SelfTrades = selfTradeResponses(selfTrades)
 		if err != nil {
-			resp += cancelQueryErrorMessage(trId, err.Error())
-			resp += "</canceled>"
 			return
 		}
+		// out of the book while it matched, it is answered here as an
+		// incoming order is rather than in reports
+		if resp.Fills, err = fillsSinceReplace(m, trId, sym); err != nil {
+			return
+		}
+
+		if stopped {
+			// it met its own account's orders: cancel whatever is left of it
+			if o.amount.Sign() > 0 {
+				if buy {
+					err = m.releaseFunds(acctId, o.release(o.amount), decimal.Zero)
+				} else {
+					err = m.addSharesToPosition(acctId, sym, o.amount)
+				}
+				if err != nil {
+					return
+				}
+				resp.SelfTrades = append(resp.SelfTrades, SelfTradeResponse{TransactionID: trId, Canceled: signed(o.amount, buy)})
+				if err = cancelUnfilled(m, trId, acctId, sym, signed(o.amount, buy), eventSelfTrade); err != nil {
+					return
+				}
+				o.amount = decimal.Zero
+			}
+			if buy {
+				err = m.closeOpenBuyOrder(trId, sym)
+			} else {
+				err = m.closeOpenSellOrder(trId, sym)
+			}
+		} else if o.amount.Sign() > 0 {
+			book.add(o)
+			if buy {
+				err = m.updateBuyOrderAmount(trId, o.amount, o.reserved)
+			} else {
+				err = m.updateSellOrderAmount(trId, o.amount.Neg())
+			}
+			if err != nil {
+				return
+			}
+			err = m.requeueOrder(trId, sym, buy, o.limit, o.seq)
+		}
+	}
+
+	resp.Amount = o.amount
+	if !buy {
+		resp.Amount = o.amount.Neg()
 	}
+	logAccount(acctId)
+	return
+}
 
-	status, err := getOrderStatus(trId)
+// fillsSinceReplace lists the trades an order made after it was last
+// replaced, from its history.
+func fillsSinceReplace(m Store, trId string, sym string) (fills []ExecutionReport, err error) {
+	events, err := m.getOrderEvents(trId)
 	if err != nil {
-		resp += cancelQueryErrorMessage(trId, err.Error())
-		resp += "</canceled>"
 		return
 	}
-	resp += status
+	for _, e := range events {
+		switch e.event {
+		case eventReplace:
+			fills = nil
+		case eventPartial, eventFill:
+			fills = append(fills, ExecutionReport{TransactionID: trId, Sym: sym, Shares: e.amount, Price: e.price, Remaining: e.remaining, Time: e.time})
+		}
+	}
+	return
+}
 
-	resp += "</canceled>"
+// cancelOpenOrder takes whatever is left of an order out of the book and
+// returns the cash or shares it was holding, recording it as event.
+// Canceling an order with nothing left is a no-op, so repeated cancels are
+// safe. must call with lock held.
+func cancelOpenOrder(m Store, trId string, event string) (acct string, err error) {
+	data, err := m.getOrder(trId)
+	if err != nil {
+		// the cache only reloads open orders, so one that is done may be
+		// known only by its history, and there is nothing left to cancel
+		if closed, _ := isClosed(m, trId); closed {
+			err = nil
+		}
+		return
+	}
+	acct, sym, amt := data.account, data.symbol, data.amount
 
+	log.WithFields(log.Fields{
+		"order info": data,
+	}).Info("Cancelling order")
 	logAccount(acct)
+
+	buy := amt.Sign() > 0
+
+	if amt.IsZero() {
+		return
+	}
+
+	// remove from open orders sorted set
+	if buy {
+		err = m.closeOpenBuyOrder(trId, sym)
+	} else {
+		err = m.closeOpenSellOrder(trId, sym)
+	}
+	if err != nil {
+		return
+	}
+	getBook(sym).remove(trId)
+
+	if buy { // release the cash the buy order reserved
+		m.releaseFunds(acct, data.reserved, decimal.Zero)
+
+	} else { // add shares back to account if sell order
+		m.addOrSetSharesToPosition(acct, sym, amt.Neg())
+	}
+
+	// set remaining amount to 0
+	if buy {
+		err = m.updateBuyOrderAmount(trId, decimal.Zero, decimal.Zero)
+	} else {
+		err = m.updateSellOrderAmount(trId, decimal.Zero)
+	}
+	if err != nil {
+		return
+	}
+
+	// store info
+	exec_time := time.Now().String()
+	err = m.cancelOrder(trId, acct, sym, amt, event, exec_time)
 	return
 }
 
-func (order *Order) openOrder(acctId string) (transId int, err error) {
+// isClosed reports whether an order's history shows it filled, canceled or
+// killed, with nothing left open.
+func isClosed(m Store, trId string) (closed bool, err error) {
+	events, err := m.getOrderEvents(trId)
+	if err != nil || len(events) == 0 {
+		return
+	}
+	return events[len(events)-1].remaining.IsZero(), nil
+}
+
+// isMarket reports whether the order takes whatever price the book offers,
+// either by saying so or by leaving out its limit.
+func (order *Order) isMarket() (market bool, err error) {
+	switch order.Type {
+	case "market":
+		if order.Limit != nil {
+			err = fmt.Errorf("Market orders take no limit")
+		}
+		return true, err
+	case "", "limit":
+		if order.Limit == nil {
+			return true, nil
+		}
+		if order.Limit.Sign() <= 0 {
+			err = fmt.Errorf("Invalid limit")
+		}
+		return false, err
+	}
+	return false, fmt.Errorf("Invalid order type")
+}
+
+// options reads the order's type, time in force, expiry and self-trade
+// prevention mode ("" if it leaves that to the account).
+func (order *Order) options() (opts orderOptions, err error) {
+	opts.market, err = order.isMarket()
+	if err != nil {
+		return
+	}
+
+	opts.stp = strings.ToLower(order.Stp)
+	if !validSelfTradePrevention(opts.stp) {
+		err = fmt.Errorf("Invalid self-trade prevention")
+		return
+	}
+
+	opts.tif = strings.ToUpper(order.Tif)
+	switch opts.tif {
+	case "":
+		// market orders never rest
+		if opts.market {
+			opts.tif = tifIOC
+		} else {
+			opts.tif = tifGTC
+		}
+	case tifIOC, tifFOK:
+	case tifGTC, tifGTD:
+		if opts.market {
+			err = fmt.Errorf("Market orders cannot rest")
+			return
+		}
+	default:
+		err = fmt.Errorf("Invalid time in force")
+		return
+	}
+
+	if opts.tif == tifGTD {
+		opts.expires, err = parseExpiry(order.Expires)
+		if err != nil {
+			return
+		}
+		if !opts.expires.After(time.Now()) {
+			err = fmt.Errorf("Order already expired")
+		}
+	} else if order.Expires != "" {
+		err = fmt.Errorf("Only GTD orders take an expiry")
+	}
+	return
+}
+
+// parseExpiry accepts either RFC 3339 or seconds since the epoch.
+func parseExpiry(expires string) (t time.Time, err error) {
+	if expires == "" {
+		return t, fmt.Errorf("GTD orders need an expiry")
+	}
+	if secs, convErr := strconv.ParseInt(expires, 10, 64); convErr == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err = time.Parse(time.RFC3339, expires)
+	if err != nil {
+		err = fmt.Errorf("Invalid expiry")
+	}
+	return
+}
+
+func (order *Order) openOrder(m Store, acctId string) (resp OpenResponse, err error) {
 	log.Info("Open order")
-	transId = IncAndGet()
-	transId_str := strconv.Itoa(transId)
 	sym := order.Sym
-	order_amt, _ := strconv.ParseFloat(order.Amount, 64)
-	limit_f, _ := strconv.ParseFloat(order.Limit, 64)
 
+	if order.Amount.IsZero() {
+		err = fmt.Errorf("Invalid amount")
+		return
+	}
+	opts, err := order.options()
+	if err != nil {
+		return
+	}
+	if opts.stp == "" {
+		opts.stp, err = accountSelfTradePrevention(m, acctId)
+		if err != nil {
+			return
+		}
+	}
+	var limit decimal.Decimal
+	if !opts.market {
+		limit = *order.Limit
+	}
+
+	transId := IncAndGet()
+	transId_str := strconv.Itoa(transId)
+
+	var outcome orderOutcome
 	// BUY
-	if order_amt > 0 {
+	if order.Amount.Sign() > 0 {
 
-		err = order.handleBuy(acctId, transId_str, sym, order_amt, limit_f)
+		outcome, err = order.handleBuy(m, acctId, transId_str, sym, order.Amount, limit, opts)
 
 		// SELL
 	} else {
 
-		err = order.handleSell(acctId, transId_str, sym, order_amt, limit_f)
+		outcome, err = order.handleSell(m, acctId, transId_str, sym, order.Amount, limit, opts)
 
 	}
+	if err != nil {
+		return
+	}
+
+	resp = OpenResponse{TransactionID: transId_str, Sym: sym, Amount: order.Amount, Limit: order.Limit}
+	if opts.market {
+		resp.Type = "market"
+	}
+	// plain limit orders keep the original response
+	if order.Tif != "" || opts.market || len(outcome.selfTrades) > 0 {
+		resp.Tif = opts.tif
+		resp.Status = outcome.status
+		resp.Expires = order.Expires
+	}
+	if !outcome.canceled.IsZero() {
+		resp.Canceled = &outcome.canceled
+	}
+	if len(outcome.selfTrades) > 0 {
+		resp.Stp = opts.stp
+		resp.SelfTrades = selfTradeResponses(outcome.selfTrades)
+	}
+	return
+}
+
+// accountSelfTradePrevention is the mode an account's orders use unless
+// they name one.
+func accountSelfTradePrevention(m Store, acctId string) (stp string, err error) {
+	stp, err = m.getSelfTradePrevention(acctId)
+	if stp == "" {
+		stp = stpNone
+	}
 	return
 }
 
-func (acct *Account) createAccount() (err error) {
+func selfTradeResponses(selfTrades []selfTrade) (resp []SelfTradeResponse) {
+	for _, st := range selfTrades {
+		resp = append(resp, SelfTradeResponse{TransactionID: st.id, Canceled: st.canceled})
+	}
+	return
+}
+
+func (acct *Account) createAccount(m Store) (err error) {
 	log.Info("Create account")
-	err = SharedModel().createAccount(acct.Id, acct.Balance)
+	stp := strings.ToLower(acct.Stp)
+	if !validSelfTradePrevention(stp) {
+		return fmt.Errorf("Invalid self-trade prevention")
+	}
+	err = m.createAccount(acct.Id, acct.Balance, stp)
 	return err
 }
 
-func createSymbol(sym *Symbol) (err error) {
+func createSymbol(m Store, sym *Symbol) (err error) {
 	log.Info("Create symbol")
 	// This creates the specified symbol. The symbol tag can have one or more
 	//children which are <account id="ID">NUM</account> These indicate that
@@ -561,10 +1295,10 @@ func createSymbol(sym *Symbol) (err error) {
 	// with the given ID. Note that this creation is legal even if sym already
 	// exists: in such a case, it is used to create more shares of that symbol
 	//and add them to existing accounts.
-	SharedModel().createOrUpdateSymbol(sym.Sym)
+	m.createOrUpdateSymbol(sym.Sym)
 
 	for _, rcv_acct := range sym.Accounts {
-		ex, _ := SharedModel().accountExists(rcv_acct.Id)
+		ex, _ := m.accountExists(rcv_acct.Id)
 		if !ex {
 			// TODO:- Handle error, account does not exist
 			log.WithFields(log.Fields{
@@ -574,20 +1308,19 @@ func createSymbol(sym *Symbol) (err error) {
 
 		} else {
 			// acct:ID:positions is a hashmap of all of the user's positions
-			amt_float, _ := strconv.ParseFloat(rcv_acct.Amount, 64)
-			SharedModel().addOrSetSharesToPosition(rcv_acct.Id, sym.Sym, amt_float)
+			m.addOrSetSharesToPosition(rcv_acct.Id, sym.Sym, rcv_acct.Amount)
 
 		}
 
 		// TEST: - Retrieve key + field, then log
-		bal_float, err := SharedModel().getPositionAmount(rcv_acct.Id, sym.Sym)
+		position, err := m.getPositionAmount(rcv_acct.Id, sym.Sym)
 		if err != nil {
 			return err
 		}
 
 		log.WithFields(log.Fields{
 			"ID":       rcv_acct.Id,
-			"Position": bal_float,
+			"Position": position,
 			"Symbol":   sym.Sym,
 		}).Info("Added shares to account")
 		// END TEST
@@ -598,232 +1331,180 @@ func createSymbol(sym *Symbol) (err error) {
 	// element is the element from someSlice for where we are
 }
 
-func parseXML(req []byte) (results string) {
+// handle carries out a request from c and returns its response, and its
+// batch, which is owed to other connections once it is journaled.
+func handle(c *Connection, req []byte) (results string, m *reportingBatch) {
 
-	defer LogMethodTimeElapsed("request_handler.parseXML", time.Now())
+	defer LogMethodTimeElapsed("request_handler.handle", time.Now())
 
-	decoder := xml.NewDecoder(bytes.NewReader(req))
-	var inElement string
-	for {
-		// Read tokens from the XML document in a stream.
-		token, _ := decoder.Token()
-		if token == nil {
-			break
+	r := decodeRequest(req)
+
+	// The whole request runs under the locks of the books and accounts it
+	// touches and commits to Postgres as one transaction, so a failure never
+	// leaves part of a trade behind and each book and balance is changed in
+	// journal order.
+	m = newReportingBatch()
+	locks := r.locks(m)
+	unlock := locks.lock()
+	defer unlock()
+	defer m.captureMarketData(locks)
+	defer m.commitBatch()
+
+	return r.format.results(r.execute(c, m)), m
+}
+
+// execute carries out the commands of a request in order and returns their
+// responses, or nil if the request was not understood.
+func (r *request) execute(c *Connection, m *reportingBatch) (resps elements) {
+	if r.err != nil {
+		log.WithFields(log.Fields{
+			"Error": r.err,
+		}).Error("Decoding error, request")
+		return elements{ErrorCreateResponse{Reason: r.err.Error()}}
+	}
+	if r.kind == "" {
+		return nil
+	}
+	if r.kind == "transactions" {
+		log.WithFields(log.Fields{
+			"Account ID": r.account,
+		}).Info("Transactions on Account ID")
+	}
+
+	resps = elements{}
+	for _, cmd := range r.commands {
+		if cmd.err != nil {
+			log.WithFields(log.Fields{
+				"Error": cmd.err,
+			}).Error("Decoding error, " + cmd.name)
+
+			resps = append(resps, r.decodingError(cmd))
+			continue
 		}
-		// Inspect the type of the token just read.
-		switch se := token.(type) {
-		case xml.StartElement:
-			// If we just read a StartElement token
-			inElement = se.Name.Local
-			// ...and its name is "create"
-			if inElement == "create" {
-				results += "<results>\n"
-				for {
-					// now we look, in order, at which create operations the user requests...
-					token_create, _ := decoder.Token()
-					if token_create == nil {
-						break
-					}
-					switch se := token_create.(type) {
-					case xml.StartElement:
-						inElement = se.Name.Local
-						switch inElement {
-						// symbol create
-						case "symbol":
-							var symb Symbol
-							err := decoder.DecodeElement(&symb, &se)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"Error": err,
-								}).Error("Decoding error, symbol")
-
-								// TODO - Handle error
-								break
-							}
-							log.WithFields(log.Fields{
-								"XML": symb,
-							}).Info("New create command: Symbol")
-
-							err = createSymbol(&symb)
-							if err == nil {
-								succ := CreatedResponse{Sym: symb.Sym}
-								if succ_string, err := xml.MarshalIndent(succ, "", "    "); err == nil {
-									results += string(succ_string) + "\n"
-								}
-							} else {
-								fail := ErrorCreateResponse{Sym: symb.Sym, Reason: err.Error()}
-								if fail_string, err := xml.MarshalIndent(fail, "", "    "); err == nil {
-									results += string(fail_string) + "\n"
-								}
-							}
-
-							// account create
-						case "account":
-							var acct Account
-							err := decoder.DecodeElement(&acct, &se)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"Error": err,
-								}).Error("Decoding error, symbol")
-
-								// TODO - Handle error
-								break
-							}
-
-							log.WithFields(log.Fields{
-								"XML": acct,
-							}).Info("New create command: Account")
-
-							err = acct.createAccount()
-							if err == nil {
-								succ := CreatedResponse{Id: acct.Id}
-								if succ_string, err := xml.MarshalIndent(succ, "", "    "); err == nil {
-									results += string(succ_string) + "\n"
-								}
-							} else {
-								fail := ErrorCreateResponse{Id: acct.Id, Reason: err.Error()}
-								if fail_string, err := xml.MarshalIndent(fail, "", "    "); err == nil {
-									results += string(fail_string) + "\n"
-								}
-							}
-
-						default:
-
-						}
-					case xml.EndElement:
-						inElement = se.Name.Local
-						// we've reached the end of this create chunk
-						if inElement == "create" {
-							break
-						}
-					default:
-					}
-				}
+		log.WithFields(log.Fields{
+			"parsed": cmd.args,
+		}).Info("New command: " + cmd.name)
 
-				results += "</results>\n"
-				return results
-			}
+		resps = append(resps, r.executeCommand(c, m, cmd.args))
+	}
+	return
+}
 
-			if inElement == "transactions" {
-				// TODO - Search for key "id" rather than assuming that is it the only key
-				if se.Attr[0].Name.Local != "id" {
-					log.Error("Did not supply ID to perform transactions on")
-					break
-				}
-				trans_acct_id := se.Attr[0].Value
-
-				log.WithFields(log.Fields{
-					"Account ID": trans_acct_id,
-				}).Info("Transactions on Account ID")
-
-				results += "<results>\n"
-				for {
-					// now we look, in order, at which create operations the user requests...
-					token_create, _ := decoder.Token()
-					if token_create == nil {
-						break
-					}
-					switch se := token_create.(type) {
-					case xml.StartElement:
-						inElement = se.Name.Local
-						switch inElement {
-						// symbol create
-						case "order":
-							var ord Order
-							err := decoder.DecodeElement(&ord, &se)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"Error": err,
-								}).Error("Decoding error, order")
-
-								// TODO - Handle error
-								break
-							}
-
-							log.WithFields(log.Fields{
-								"parsed": ord,
-							}).Info("Order")
-
-							tr_id, err := ord.openOrder(trans_acct_id)
-							if err == nil {
-								succ := OpenResponse{TransactionID: strconv.Itoa(tr_id), Sym: ord.Sym, Amount: ord.Amount, Limit: ord.Limit}
-								if succ_string, err := xml.MarshalIndent(succ, "", "    "); err == nil {
-									results += string(succ_string) + "\n"
-								}
-							} else {
-								fail := ErrorTransResponse{Sym: ord.Sym, Amount: ord.Amount, Limit: ord.Limit, Reason: err.Error()}
-								if fail_string, err := xml.MarshalIndent(fail, "", "    "); err == nil {
-									results += string(fail_string) + "\n"
-								}
-							}
-
-						case "cancel":
-							var cancel Cancel
-							err := decoder.DecodeElement(&cancel, &se)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"Error": err,
-								}).Error("Decoding error, cancel")
-
-								// TODO - Handle error
-								break
-							}
-
-							log.WithFields(log.Fields{
-								"parsed": cancel,
-							}).Info("Cancel")
-
-							resp_c, _ := cancel.handleCancel()
-							results += resp_c + "\n"
-
-						case "query":
-							var qry Query
-							err := decoder.DecodeElement(&qry, &se)
-							if err != nil {
-								log.WithFields(log.Fields{
-									"Error": err,
-								}).Error("Decoding error, query")
-
-								// TODO - Handle error
-								break
-							}
-
-							log.WithFields(log.Fields{
-								"parsed": qry,
-							}).Info("Query")
-
-							resp_q, _ := qry.handleQuery()
-							results += resp_q + "\n"
-						default:
-
-						}
-					case xml.EndElement:
-						inElement = se.Name.Local
-						// we've reached the end of this create chunk
-						if inElement == "transactions" {
-							break
-						}
-					}
+// decodingError is the response to a command that did not decode, with as
+// much of it as was sent echoed back.
+func (r *request) decodingError(cmd command) interface{} {
+	reason := cmd.err.Error()
+	switch cmd.name {
+	case "account":
+		return ErrorCreateResponse{Id: cmd.sent["id"], Reason: reason}
+	case "symbol", "book":
+		return ErrorCreateResponse{Sym: cmd.sent["sym"], Reason: reason}
+	case "order":
+		return ErrorTransResponse{Sym: cmd.sent["sym"], Amount: cmd.sent["amount"], Limit: cmd.sent["limit"], Reason: reason}
+	case "cancel", "query", "replace":
+		return cancelQueryError(cmd.sent["id"], reason)
+	case "subscribe", "balance", "positions", "orders":
+		return cancelQueryError(r.account, reason)
+	}
+	return ErrorCreateResponse{Reason: reason}
+}
 
-				}
-				results += "</results>\n"
-				return results
-			}
+// executeCommand carries out one command and returns its response.
+func (r *request) executeCommand(c *Connection, m *reportingBatch, args interface{}) interface{} {
+	switch args := args.(type) {
+	case *Symbol:
+		if err := createSymbol(m, args); err != nil {
+			return ErrorCreateResponse{Sym: args.Sym, Reason: err.Error()}
+		}
+		return CreatedResponse{Sym: args.Sym}
 
-			if inElement == "dump" {
-				outputDatabaseStateTruncated(50)
-				// store the output to the var "results"
+	case *Account:
+		if err := args.createAccount(m); err != nil {
+			return ErrorCreateResponse{Id: args.Id, Reason: err.Error()}
+		}
+		return CreatedResponse{Id: args.Id}
+
+	case *Order:
+		succ, err := args.openOrder(m, r.account)
+		if err != nil {
+			fail := ErrorTransResponse{Sym: args.Sym, Amount: args.Amount.String(), Reason: err.Error()}
+			if args.Limit != nil {
+				fail.Limit = args.Limit.String()
 			}
-		default:
+			return fail
+		}
+		// the account's fills are reported to whoever trades it
+		c.subscribe(r.account, r.format)
+		return succ
+
+	case *Cancel:
+		resp, _ := args.handleCancel(m)
+		return resp
+
+	case *Query:
+		resp, _ := args.handleQuery(m)
+		return resp
+
+	case *Subscribe:
+		if exists, _ := m.accountExists(r.account); !exists {
+			return cancelQueryError(r.account, "Account does not exist")
+		}
+		c.subscribe(r.account, r.format)
+		return SubscribedResponse{Id: r.account}
+
+	case *Balance, *Positions, *Orders:
+		var resp interface{}
+		var err error
+		switch args := args.(type) {
+		case *Balance:
+			resp, err = handleBalance(m, r.account)
+		case *Positions:
+			resp, err = handlePositions(m, r.account)
+		case *Orders:
+			resp, err = args.handleOrders(m, r.account)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Account inquiry")
+			return cancelQueryError(r.account, err.Error())
+		}
+		return resp
+
+	case *Replace:
+		succ, err := args.handleReplace(m, r.account)
+		if err != nil {
+			return cancelQueryError(args.TransactionID, err.Error())
+		}
+		return succ
+
+	case *Book:
+		resp, err := args.handleBook(m)
+		if err != nil {
+			return ErrorCreateResponse{Sym: args.Sym, Reason: err.Error()}
+		}
+		return resp
+
+	case *Dump:
+		resp, err := args.handleDump(m)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"Error": err,
+			}).Error("Dump")
+			return ErrorCreateResponse{Reason: err.Error()}
 		}
+		return resp
 	}
-	return ""
+	return nil
 }
 
 // Send bytes to Connection
 func (c *Connection) handleRequest(req []byte) {
 	// New Message Received
 	defer LogMethodTimeElapsed("request_handler.handleRequest", time.Now())
-	results := parseXML(req)
+	results, batch := handle(c, req)
+	// nothing is acknowledged, or reported, until it is in the journal
+	SharedStore().syncJournal()
 	c.Send(results)
+	batch.publish()
 }
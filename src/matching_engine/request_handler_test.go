@@ -0,0 +1,343 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/farice/EME/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// These run the handlers against a MemoryStore, so they need no services.
+
+func TestMain(m *testing.M) {
+	// the handlers log every step, and the refusals tested here as errors
+	log.SetOutput(ioutil.Discard)
+	log.SetLevel(log.FatalLevel)
+	os.Exit(m.Run())
+}
+
+// reset starts each test with an empty exchange.
+func reset() *MemoryStore {
+	s := NewMemoryStore()
+	store = s
+	books_mux.Lock()
+	books = make(map[string]*OrderBook)
+	books_mux.Unlock()
+	return s
+}
+
+func dec(t *testing.T, s string) decimal.Decimal {
+	d, err := decimal.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func decp(t *testing.T, s string) *decimal.Decimal {
+	d := dec(t, s)
+	return &d
+}
+
+func createAccount(t *testing.T, m Store, id string, balance string, shares map[string]string) {
+	acct := &Account{Id: id, Balance: dec(t, balance)}
+	if err := acct.createAccount(m); err != nil {
+		t.Fatal(err)
+	}
+	for sym, amount := range shares {
+		s := &Symbol{Sym: sym}
+		s.Accounts = append(s.Accounts, struct {
+			Id     string          `xml:"id,attr" json:"id"`
+			Amount decimal.Decimal `xml:",chardata" json:"amount"`
+		}{id, dec(t, amount)})
+		if err := createSymbol(m, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func openOrder(t *testing.T, m Store, acct string, order Order) OpenResponse {
+	resp, err := order.openOrder(m, acct)
+	if err != nil {
+		t.Fatalf("order %+v: %v", order, err)
+	}
+	return resp
+}
+
+func expectFunds(t *testing.T, m Store, acct string, balance string, reserved string) {
+	t.Helper()
+	b, r, err := m.getAccountFunds(acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != balance || r.String() != reserved {
+		t.Errorf("account %s: balance %s reserved %s, want %s and %s", acct, b, r, balance, reserved)
+	}
+}
+
+func expectPosition(t *testing.T, m Store, acct string, sym string, shares string) {
+	t.Helper()
+	p, err := m.getPositionAmount(acct, sym)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.String() != shares {
+		t.Errorf("account %s holds %s %s, want %s", acct, p, sym, shares)
+	}
+}
+
+func TestBuyFillsAtRestingPrice(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "seller", "0", map[string]string{"SPY": "100"})
+	createAccount(t, m, "buyer", "1000", nil)
+
+	openOrder(t, m, "seller", Order{Sym: "SPY", Amount: dec(t, "-10"), Limit: decp(t, "5")})
+	expectPosition(t, m, "seller", "SPY", "90")
+
+	openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "6")})
+	expectFunds(t, m, "buyer", "950", "0")
+	expectFunds(t, m, "seller", "50", "0")
+	expectPosition(t, m, "buyer", "SPY", "10")
+}
+
+func TestBuyRestsAndReserves(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "buyer", "1000", nil)
+
+	resp := openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "12.5")})
+	expectFunds(t, m, "buyer", "1000", "125")
+
+	status, err := getOrderStatus(m, resp.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0] != (OpenQueryResponse{Shares: dec(t, "10")}) {
+		t.Errorf("status %+v, want 10 open", status)
+	}
+}
+
+func TestOrdersRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  Order
+		reason string
+	}{
+		{"buy beyond balance", Order{Sym: "SPY", Amount: dec(t, "1000"), Limit: decp(t, "2")}, "Insufficient funds"},
+		{"sell beyond position", Order{Sym: "SPY", Amount: dec(t, "-101"), Limit: decp(t, "2")}, "Insufficient funds"},
+		{"buy cost overflows", Order{Sym: "SPY", Amount: dec(t, "1000000000000"), Limit: decp(t, "1000000000000")}, "Order value out of range"},
+		{"sell proceeds overflow", Order{Sym: "SPY", Amount: dec(t, "-100"), Limit: decp(t, "1000000000000")}, "Order value out of range"},
+		{"buy cost rounds to nothing", Order{Sym: "SPY", Amount: dec(t, "0.000001"), Limit: decp(t, "0.000001")}, "Order value out of range"},
+		{"no amount", Order{Sym: "SPY", Limit: decp(t, "2")}, "Invalid amount"},
+	}
+	for _, test := range tests {
+		m := reset()
+		createAccount(t, m, "1", "1000", map[string]string{"SPY": "100"})
+		if _, err := test.order.openOrder(m, "1"); err == nil || err.Error() != test.reason {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.reason)
+		}
+		expectFunds(t, m, "1", "1000", "0")
+		expectPosition(t, m, "1", "SPY", "100")
+	}
+}
+
+func TestSellPartiallyFills(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "buyer", "1000", nil)
+	createAccount(t, m, "seller", "0", map[string]string{"SPY": "100"})
+
+	buy := openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "7")})
+	sell := openOrder(t, m, "seller", Order{Sym: "SPY", Amount: dec(t, "-25"), Limit: decp(t, "6")})
+
+	expectFunds(t, m, "buyer", "930", "0")
+	expectFunds(t, m, "seller", "70", "0")
+	expectPosition(t, m, "seller", "SPY", "75")
+
+	status, err := getOrderStatus(m, buy.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 1 || status[0].(ExecutedQueryResponse).Price.String() != "7" {
+		t.Errorf("buy status %+v, want one fill at 7", status)
+	}
+	status, err = getOrderStatus(m, sell.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 2 || status[1] != (OpenQueryResponse{Shares: dec(t, "-15")}) {
+		t.Errorf("sell status %+v, want a fill and 15 open", status)
+	}
+}
+
+func TestCancelReleasesOrder(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "buyer", "1000", nil)
+	createAccount(t, m, "seller", "0", map[string]string{"SPY": "100"})
+
+	buy := openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "5")})
+	sell := openOrder(t, m, "seller", Order{Sym: "SPY", Amount: dec(t, "-20"), Limit: decp(t, "9")})
+
+	for _, id := range []string{buy.TransactionID, sell.TransactionID} {
+		resp, err := (&Cancel{TransactionID: id}).handleCancel(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Items) != 1 || elementName(resp.Items[0]) != "canceled" {
+			t.Errorf("cancel %s: %+v", id, resp.Items)
+		}
+	}
+	expectFunds(t, m, "buyer", "1000", "0")
+	expectPosition(t, m, "seller", "SPY", "100")
+	if levels := getBook("SPY").depth(true); len(levels) != 0 {
+		t.Errorf("book still holds %+v", levels)
+	}
+
+	// canceling again reports the same history rather than failing
+	resp, err := (&Cancel{TransactionID: buy.TransactionID}).handleCancel(m)
+	if err != nil || len(resp.Items) != 1 || resp.Items[0].(CancelQueryResponse).Shares.String() != "10" {
+		t.Errorf("second cancel: %+v, %v", resp.Items, err)
+	}
+	expectFunds(t, m, "buyer", "1000", "0")
+}
+
+func TestCancelUnknown(t *testing.T) {
+	m := reset()
+	for _, id := range []string{"", "42"} {
+		resp, err := (&Cancel{TransactionID: id}).handleCancel(m)
+		if err == nil || len(resp.Items) != 1 {
+			t.Errorf("cancel %q: %+v, %v", id, resp.Items, err)
+			continue
+		}
+		if e, ok := resp.Items[0].(ErrorQueryCancelResponse); !ok || e.Reason != err.Error() {
+			t.Errorf("cancel %q: %+v", id, resp.Items[0])
+		}
+	}
+}
+
+func TestSelfTradeDecrement(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "1", "1000", map[string]string{"SPY": "50"})
+
+	openOrder(t, m, "1", Order{Sym: "SPY", Amount: dec(t, "-10"), Limit: decp(t, "5")})
+	resp := openOrder(t, m, "1", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "5"), Stp: stpDecrement})
+
+	if resp.Status != statusCanceled || resp.Canceled == nil || resp.Canceled.String() != "10" {
+		t.Errorf("status %s canceled %v, want canceled 10", resp.Status, resp.Canceled)
+	}
+	if len(resp.SelfTrades) != 2 {
+		t.Errorf("self trades %+v, want both orders", resp.SelfTrades)
+	}
+	expectFunds(t, m, "1", "1000", "0")
+	expectPosition(t, m, "1", "SPY", "50")
+}
+
+// A replace whose new limit crosses the book answers with what it traded.
+func TestReplaceReportsFills(t *testing.T) {
+	m := reset()
+	createAccount(t, m, "buyer", "1000", nil)
+	createAccount(t, m, "seller", "0", map[string]string{"SPY": "100"})
+
+	openOrder(t, m, "seller", Order{Sym: "SPY", Amount: dec(t, "-4"), Limit: decp(t, "5")})
+	buy := openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "10"), Limit: decp(t, "4")})
+
+	resp, err := (&Replace{TransactionID: buy.TransactionID, Limit: decp(t, "6")}).handleReplace(m, "buyer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Priority != "lost" || resp.Amount.String() != "6" {
+		t.Errorf("replaced %+v, want 6 left with priority lost", resp)
+	}
+	if len(resp.Fills) != 1 {
+		t.Fatalf("fills %+v, want one", resp.Fills)
+	}
+	if f := resp.Fills[0]; f.TransactionID != buy.TransactionID || f.Shares.String() != "4" || f.Price.String() != "5" || f.Remaining.String() != "6" {
+		t.Errorf("fill %+v, want 4 at 5 with 6 left", f)
+	}
+	expectFunds(t, m, "buyer", "980", "36")
+	expectPosition(t, m, "buyer", "SPY", "4")
+
+	// a replace that keeps its place trades nothing
+	resp, err = (&Replace{TransactionID: buy.TransactionID, Amount: decp(t, "3")}).handleReplace(m, "buyer")
+	if err != nil || resp.Priority != "kept" || len(resp.Fills) != 0 {
+		t.Errorf("replaced %+v, %v, want kept without fills", resp, err)
+	}
+	expectFunds(t, m, "buyer", "980", "18")
+}
+
+// A buy whose reservation does not divide evenly among its fills gives all
+// of it back, and never more, whether it fills or is canceled.
+func TestUnevenReservationReleased(t *testing.T) {
+	for fills := 1; fills <= 3; fills++ {
+		m := reset()
+		createAccount(t, m, "buyer", "10", nil)
+		createAccount(t, m, "seller", "0", map[string]string{"SPY": "10"})
+
+		buy := openOrder(t, m, "buyer", Order{Sym: "SPY", Amount: dec(t, "1.5"), Limit: decp(t, "0.333333")})
+		expectFunds(t, m, "buyer", "10", "0.5")
+		for i := 0; i < fills; i++ {
+			openOrder(t, m, "seller", Order{Sym: "SPY", Amount: dec(t, "-0.5"), Limit: decp(t, "0.333333")})
+		}
+		if fills < 3 {
+			if _, err := (&Cancel{TransactionID: buy.TransactionID}).handleCancel(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// each fill is paid at its own rounded value
+		paid := dec(t, "0.166667").Mul(dec(t, strconv.Itoa(fills)))
+		expectFunds(t, m, "buyer", dec(t, "10").Sub(paid).String(), "0")
+		expectFunds(t, m, "seller", paid.String(), "0")
+	}
+}
+
+// Orders from many goroutines, as from many connections, taking the locks
+// handle does, neither lose nor make cash or shares. Each symbol's taker
+// runs alongside the others, and all of them trade with the same resting
+// account, which none of them locks. Run with -race.
+func TestConcurrentOrders(t *testing.T) {
+	m := reset()
+	symbols := []string{"SPY", "QQQ", "DIA"}
+	holdings := make(map[string]string)
+	for _, sym := range symbols {
+		holdings[sym] = "1000"
+	}
+	createAccount(t, m, "maker", "100000", holdings)
+	for _, sym := range symbols {
+		createAccount(t, m, "taker-"+sym, "10000", map[string]string{sym: "1000"})
+		openOrder(t, m, "maker", Order{Sym: sym, Amount: dec(t, "-100"), Limit: decp(t, "10")})
+		openOrder(t, m, "maker", Order{Sym: sym, Amount: dec(t, "100"), Limit: decp(t, "9")})
+	}
+
+	var wg sync.WaitGroup
+	for _, sym := range symbols {
+		for i := 0; i < 20; i++ {
+			for _, order := range []Order{
+				{Sym: sym, Amount: dec(t, "5"), Limit: decp(t, "10")},
+				{Sym: sym, Amount: dec(t, "-5"), Limit: decp(t, "9")},
+			} {
+				wg.Add(1)
+				go func(acct string, order Order) {
+					defer wg.Done()
+					r := &request{kind: "transactions", account: acct, commands: []command{{name: "order", args: &order}}}
+					unlock := r.locks(m).lock()
+					defer unlock()
+					if _, err := order.openOrder(m, acct); err != nil {
+						t.Error(err)
+					}
+				}("taker-"+sym, order)
+			}
+		}
+	}
+	wg.Wait()
+
+	// the maker sold 100 at 10 and bought 100 at 9 of each
+	expectFunds(t, m, "maker", "100300", "0")
+	for _, sym := range symbols {
+		expectPosition(t, m, "maker", sym, "1000")
+		expectFunds(t, m, "taker-"+sym, "9900", "0")
+		expectPosition(t, m, "taker-"+sym, sym, "1000")
+	}
+}
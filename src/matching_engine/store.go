@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+
+	"github.com/farice/EME/decimal"
+)
+
+// Store is everything request handling needs from the data layer. Model
+// keeps it in Redis and Postgres; MemoryStore keeps it in process, so the
+// exchange can run without either.
+type Store interface {
+	// Requests
+	beginBatch() Store
+	commitBatch()
+	executeQueries()
+	syncJournal()
+
+	// Counters
+	incTransactionCounter() (int, error)
+
+	// Accounts
+	createAccount(uid string, balance decimal.Decimal, stp string) error
+	getSelfTradePrevention(accountID string) (string, error)
+	getAccountBalance(accountID string) (decimal.Decimal, error)
+	getAccountFunds(accountID string) (balance decimal.Decimal, reserved decimal.Decimal, err error)
+	addAccountBalance(accountID string, amount decimal.Decimal) error
+	reserveFunds(accountID string, amount decimal.Decimal) error
+	releaseFunds(accountID string, released decimal.Decimal, spent decimal.Decimal) error
+	accountExists(accountID string) (bool, error)
+
+	// Positions
+	createOrUpdateSymbol(symbol string) error
+	addOrSetSharesToPosition(accountID string, symbol string, amount decimal.Decimal) error
+	addSharesToPosition(accountID string, symbol string, amount decimal.Decimal) error
+	getPositionAmount(accountID string, symbol string) (decimal.Decimal, error)
+	getPositions(accountID string) (map[string]decimal.Decimal, error)
+
+	// Orders
+	createOrder(transID string, acctID string, sym string, limit decimal.Decimal, amount decimal.Decimal, transactionTime time.Time) error
+	transactionExists(transID string) (bool, error)
+	getOrder(orderID string) (orderInfo, error)
+	getOrderSeq(orderID string) (uint64, error)
+	getAccountOrders(accountID string) ([]accountOrder, error)
+	createBuyOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, reserved decimal.Decimal, seq uint64) error
+	createSellOrder(uid string, accountID string, symbol string, amount decimal.Decimal, priceLimit decimal.Decimal, seq uint64) error
+	updateBuyOrderAmount(uid string, newAmount decimal.Decimal, reserved decimal.Decimal) error
+	updateSellOrderAmount(uid string, newAmount decimal.Decimal) error
+	closeOpenBuyOrder(uid string, sym string) error
+	closeOpenSellOrder(uid string, sym string) error
+	getOpenOrders(symbol string, buy bool) ([]string, error)
+	requeueOrder(uid string, symbol string, buy bool, priceLimit decimal.Decimal, seq uint64) error
+	cancelOrder(trId string, accountID string, symbol string, amt decimal.Decimal, event string, timestamp string) error
+
+	// Expiry
+	setOrderExpiry(uid string, buy bool, expires time.Time) error
+	clearOrderExpiry(uid string) error
+	getExpiredOrders(now time.Time) ([]string, error)
+
+	// Executions and history
+	recordTrade(buyID string, sellID string, buyer string, seller string, symbol string, shares decimal.Decimal, price decimal.Decimal, time string) (int, error)
+	recordOrderEvent(orderID string, accountID string, symbol string, event string, amount decimal.Decimal, price decimal.Decimal, remaining decimal.Decimal, time string)
+	getOrderEvents(orderID string) ([]orderEvent, error)
+
+	// Administration
+	dumpRows(t dumpTable, filter dumpFilter, limit int) ([][]string, error)
+}
+
+// Storage backends selectable at startup
+const (
+	storeRedis  = "redis"  // Redis cache in front of Postgres
+	storeMemory = "memory" // in process only, lost on exit
+)
+
+var store Store
+
+// SharedStore is the store chosen at startup.
+func SharedStore() Store {
+	return store
+}
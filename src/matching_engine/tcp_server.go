@@ -14,8 +14,17 @@ import (
 type Connection struct {
 	conn   net.Conn
 	Server *server
+
+	pushes chan []byte   // unrequested messages waiting to be written
+	done   chan struct{} // closed once the connection is
+
+	accounts map[string]bool // whose fills are reported here, guarded by subscribers_mux
+	symbols  map[string]bool // whose market data is sent here, guarded by feeds_mux
 }
 
+// Pushed messages a connection may have waiting before it counts as too slow
+const pushQueueLength = 1024
+
 // TCP server
 type server struct {
 	address                  string // Address to open connection
@@ -32,8 +41,7 @@ func (c *Connection) listen() {
 	for {
 		message_length, err := reader.ReadString('\n')
 		if err != nil {
-			c.conn.Close()
-			c.Server.onClientConnectionClosed(c, err)
+			c.closed(err)
 			return
 		}
 
@@ -42,8 +50,7 @@ func (c *Connection) listen() {
 		// message_length should indicate number of bytes of XML to read
 		len_msg, err := strconv.Atoi(message_length)
 		if err != nil {
-			c.conn.Close()
-			c.Server.onClientConnectionClosed(c, err)
+			c.closed(err)
 			return
 		}
 
@@ -52,8 +59,7 @@ func (c *Connection) listen() {
 		bytes_read, err := reader.Read(msg)
 		// ensure that bytes read matches length specified of XML request
 		if err != nil || bytes_read != len_msg {
-			c.conn.Close()
-			c.Server.onClientConnectionClosed(c, err)
+			c.closed(err)
 			return
 		}
 
@@ -61,6 +67,50 @@ func (c *Connection) listen() {
 	}
 }
 
+func (c *Connection) closed(err error) {
+	c.conn.Close()
+	close(c.done)
+	c.Server.onClientConnectionClosed(c, err)
+}
+
+// Push queues a message the client did not ask for, such as an execution
+// report, to be written by the connection's own goroutine, so that a slow
+// client holds up no one else. One that falls too far behind is
+// disconnected.
+func (c *Connection) Push(message []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case c.pushes <- message:
+	default:
+		log.WithFields(log.Fields{
+			"remote": c.conn.RemoteAddr(),
+		}).Warn("Pushed messages backed up, disconnecting client")
+		// its listen loop then fails and reports it closed
+		c.conn.Close()
+	}
+}
+
+// writePushes writes pushed messages until the connection closes.
+func (c *Connection) writePushes() {
+	for {
+		select {
+		case message := <-c.pushes:
+			if err := c.SendBytes(message); err != nil {
+				log.WithFields(log.Fields{
+					"remote": c.conn.RemoteAddr(),
+					"error":  err,
+				}).Error("Failed to push message")
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
 // Send text message to Connection
 func (c *Connection) Send(message string) error {
 	defer LogMethodTimeElapsed("tcp_server.Send", time.Now())
@@ -115,10 +165,13 @@ func (s *server) Listen() {
 		client_connection := &Connection{
 			conn:   conn,
 			Server: s,
+			pushes: make(chan []byte, pushQueueLength),
+			done:   make(chan struct{}),
 		}
 
 		// lightweight thread managed by the Go runtime
 		go client_connection.listen()
+		go client_connection.writePushes()
 		s.onNewConnectionCallback(client_connection)
 	}
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farice/EME/decimal"
+	"github.com/farice/EME/redis"
+	redigo "github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// What the cache warm-up loaded, and how much of the cache disagreed with it
+type warmupReport struct {
+	accounts        int
+	positions       int
+	symbols         int
+	buyOrders       int
+	sellOrders      int
+	histories       int // orders whose history was loaded
+	accountOrders   int // accounts whose list of orders was loaded
+	inconsistencies int
+	cacheOnly       map[string]int // of each kind, entries Postgres has none of
+}
+
+func (r *warmupReport) inconsistent(msg string, fields log.Fields) {
+	r.inconsistencies++
+	log.WithFields(fields).Warn("Cache inconsistency: " + msg)
+}
+
+// onlyInCache reports an entry of kind that the cache holds and Postgres
+// does not.
+func (r *warmupReport) onlyInCache(kind string, fields log.Fields) {
+	if r.cacheOnly == nil {
+		r.cacheOnly = make(map[string]int)
+	}
+	r.cacheOnly[kind]++
+	r.inconsistent(kind+" only in cache", fields)
+}
+
+// warmCache loads Postgres into Redis so that nothing the database knows
+// about is missing from the cache, e.g. after Redis restarts empty. It runs
+// after the journal has been replayed, so Postgres holds everything the
+// exchange acknowledged and wins wherever the two disagree. What only the
+// cache holds is counted by kind; open orders are closed, the rest is left
+// for `matching_engine reconcile`. Must run before the exchange starts
+// taking requests.
+func (m *Model) warmCache() (report warmupReport, err error) {
+	defer LogMethodTimeElapsed("model.warmCache", time.Now())
+
+	if err = m.warmAccounts(&report); err != nil {
+		return
+	}
+	if err = m.warmPositions(&report); err != nil {
+		return
+	}
+	if err = m.warmSymbols(&report); err != nil {
+		return
+	}
+	var maxID int
+	for _, buy := range []bool{true, false} {
+		var top int
+		if top, err = m.warmOpenOrders(buy, &report); err != nil {
+			return
+		}
+		if top > maxID {
+			maxID = top
+		}
+	}
+	// orders that have traded and closed are only left in the execution table
+	var maxTrade, maxExecuted int
+	err = m.db.QueryRow(`SELECT COALESCE(MAX(trade_id), 0),
+		COALESCE(MAX(GREATEST(CASE WHEN buy_order_id ~ '^[0-9]+$' THEN buy_order_id::bigint END, CASE WHEN sell_order_id ~ '^[0-9]+$' THEN sell_order_id::bigint END)), 0)
+		FROM execution`).Scan(&maxTrade, &maxExecuted)
+	if err != nil {
+		return
+	}
+	if maxExecuted > maxID {
+		maxID = maxExecuted
+	}
+	// and orders canceled or killed without trading only in their history
+	var maxEvent int
+	err = m.db.QueryRow(`SELECT COALESCE(MAX(CASE WHEN order_id ~ '^[0-9]+$' THEN order_id::bigint END), 0) FROM order_event`).Scan(&maxEvent)
+	if err != nil {
+		return
+	}
+	if maxEvent > maxID {
+		maxID = maxEvent
+	}
+	if err = restoreCounter("TransactionCounter", maxID, &report); err != nil {
+		return
+	}
+	if err = restoreCounter("TradeCounter", maxTrade, &report); err != nil {
+		return
+	}
+	if err = m.warmHistory(&report); err != nil {
+		return
+	}
+
+	// books are rebuilt from the cache the next time each symbol is used
+	books_mux.Lock()
+	books = make(map[string]*OrderBook)
+	books_mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"accounts":        report.accounts,
+		"positions":       report.positions,
+		"symbols":         report.symbols,
+		"buy orders":      report.buyOrders,
+		"sell orders":     report.sellOrders,
+		"histories":       report.histories,
+		"account orders":  report.accountOrders,
+		"inconsistencies": report.inconsistencies,
+		"only in cache":   report.cacheOnly,
+	}).Info("Warmed cache from Postgres")
+	return
+}
+
+func (m *Model) warmAccounts(report *warmupReport) (err error) {
+	rows, err := m.db.Query(`SELECT uid, balance, reserved, stp FROM account`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var uid, stp string
+		var balance, reserved decimal.Decimal
+		if err = rows.Scan(&uid, &balance, &reserved, &stp); err != nil {
+			return
+		}
+		stored[uid] = true
+		if stp != "" {
+			if err = redis.SetField("acct:"+uid, "stp", stp); err != nil {
+				return
+			}
+		}
+		for _, field := range []struct {
+			name  string
+			value decimal.Decimal
+		}{{"balance", balance}, {"reserved", reserved}} {
+			cached, _ := redis.GetField("acct:"+uid, field.name)
+			if cached != nil {
+				var c decimal.Decimal
+				if c.RedisScan(cached) == nil && c.Cmp(field.value) == 0 {
+					continue
+				}
+				report.inconsistent("account "+field.name, log.Fields{"ID": uid, "cache": c, "postgres": field.value})
+			}
+			if err = redis.SetField("acct:"+uid, field.name, field.value); err != nil {
+				return
+			}
+		}
+		report.accounts++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	keys, err := redis.GetKeys("acct:*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		uid := strings.TrimPrefix(key, "acct:")
+		if !strings.HasSuffix(key, ":positions") && !stored[uid] {
+			report.onlyInCache("account", log.Fields{"ID": uid})
+		}
+	}
+	return
+}
+
+func (m *Model) warmPositions(report *warmupReport) (err error) {
+	rows, err := m.db.Query(`SELECT account_id, symbol, amount FROM position`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var accountID, symbol string
+		var amount decimal.Decimal
+		if err = rows.Scan(&accountID, &symbol, &amount); err != nil {
+			return
+		}
+		key := "acct:" + accountID + ":positions"
+		stored[key+" "+symbol] = true
+		cached, _ := redis.GetField(key, symbol)
+		if cached != nil {
+			var c decimal.Decimal
+			if c.RedisScan(cached) == nil && c.Cmp(amount) == 0 {
+				report.positions++
+				continue
+			}
+			report.inconsistent("position", log.Fields{"ID": accountID, "Symbol": symbol, "cache": c, "postgres": amount})
+		}
+		if err = redis.SetField(key, symbol, amount); err != nil {
+			return
+		}
+		report.positions++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	keys, err := redis.GetKeys("acct:*:positions")
+	if err != nil {
+		return
+	}
+	conn := redis.Pool.Get()
+	defer conn.Close()
+	for _, key := range keys {
+		symbols, _ := redigo.Strings(conn.Do("HKEYS", key))
+		for _, symbol := range symbols {
+			if !stored[key+" "+symbol] {
+				report.onlyInCache("position", log.Fields{"ID": strings.TrimSuffix(strings.TrimPrefix(key, "acct:"), ":positions"), "Symbol": symbol})
+			}
+		}
+	}
+	return
+}
+
+func (m *Model) warmSymbols(report *warmupReport) (err error) {
+	rows, err := m.db.Query(`SELECT name FROM symbol`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	stored := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+		stored[name] = true
+		if ex, _ := redis.Exists("sym:" + name); !ex {
+			if err = redis.Set("sym:"+name, ""); err != nil {
+				return
+			}
+		}
+		report.symbols++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	keys, err := redis.GetKeys("sym:*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if name := strings.TrimPrefix(key, "sym:"); !stored[name] {
+			report.onlyInCache("symbol", log.Fields{"Symbol": name})
+		}
+	}
+	return
+}
+
+// What a stored buy still holds for its remaining shares. Rows written
+// before buys kept their reservation held the full remainder at the limit.
+const storedReservation = `COALESCE(reserved, ROUND(amount * price_limit, 6))`
+
+// warmOpenOrders rebuilds one side of every book in the cache. Orders the
+// cache holds open but Postgres does not are closed. Returns the highest
+// numeric order id seen.
+func (m *Model) warmOpenOrders(buy bool, report *warmupReport) (maxID int, err error) {
+	table, set, reserved := "sell_order", "open-sell:", "0"
+	if buy {
+		table, set, reserved = "buy_order", "open-buy:", storedReservation
+	}
+
+	rows, err := m.db.Query(`SELECT uid, account_id, symbol, price_limit, amount, ` + reserved + `, seq, expires_at FROM ` + table)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	open := make(map[string]bool)
+	for rows.Next() {
+		var uid, accountID, symbol string
+		var limit, amount, reservation decimal.Decimal
+		var seq, expires sql.NullInt64
+		if err = rows.Scan(&uid, &accountID, &symbol, &limit, &amount, &reservation, &seq, &expires); err != nil {
+			return
+		}
+		open[uid] = true
+		if id, convErr := strconv.Atoi(uid); convErr == nil && id > maxID {
+			maxID = id
+		}
+
+		var cached decimal.Decimal
+		if data, _ := conn.Do("HGET", "order:"+uid, "amount"); data == nil {
+			report.inconsistent("open order missing", log.Fields{"transId": uid})
+		} else if cached.RedisScan(data) != nil || cached.Cmp(amount) != 0 {
+			report.inconsistent("open order amount", log.Fields{"transId": uid, "cache": cached, "postgres": amount})
+		}
+
+		_, err = conn.Do("HMSET", "order:"+uid, "account", accountID, "symbol", symbol, "limit", limit, "amount", amount, "reserved", reservation)
+		if err != nil {
+			return
+		}
+		// the original size is only kept in the cache
+		conn.Do("HSETNX", "order:"+uid, "origAmount", amount)
+		if seq.Valid {
+			conn.Do("HSET", "order:"+uid, "seq", seq.Int64)
+		}
+		if err = redis.Zadd(set+symbol, limit.Units(), uid); err != nil {
+			return
+		}
+		if expires.Valid {
+			if err = redis.Zadd("order-expiry", expires.Int64, uid); err != nil {
+				return
+			}
+		}
+
+		if buy {
+			report.buyOrders++
+		} else {
+			report.sellOrders++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	keys, err := redis.GetKeys(set + "*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		members, _ := redis.Zrange(key, 0, -1, false)
+		for _, uid := range members {
+			if open[uid] {
+				continue
+			}
+			report.onlyInCache("open order", log.Fields{"transId": uid, "set": key})
+			conn.Do("ZREM", key, uid)
+			conn.Do("ZREM", "order-expiry", uid)
+			conn.Do("HSET", "order:"+uid, "amount", decimal.Zero)
+		}
+	}
+	return
+}
+
+// warmHistory loads the history of every order, and every account's list of
+// the orders it placed, into the cache lists they are read from.
+func (m *Model) warmHistory(report *warmupReport) (err error) {
+	rows, err := m.db.Query(`SELECT order_id, account_id, symbol, event, amount, price, remaining, event_time FROM order_event ORDER BY event_id`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	histories := make(map[string][]string)
+	accountOrders := make(map[string][]string)
+	for rows.Next() {
+		var orderID, accountID, symbol string
+		var e orderEvent
+		if err = rows.Scan(&orderID, &accountID, &symbol, &e.event, &e.amount, &e.price, &e.remaining, &e.time); err != nil {
+			return
+		}
+		histories[orderID] = append(histories[orderID], encodeOrderEvent(e))
+		if e.event == eventOpen {
+			placed := accountOrder{id: orderID, symbol: symbol, amount: e.amount, limit: e.price}
+			accountOrders[accountID] = append(accountOrders[accountID], encodeAccountOrder(placed))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if err = warmLists("order-events:", histories, "order history", report); err != nil {
+		return
+	}
+	report.histories = len(histories)
+	if err = warmLists("acct-orders:", accountOrders, "account orders", report); err != nil {
+		return
+	}
+	report.accountOrders = len(accountOrders)
+	return
+}
+
+// warmLists makes the cache list under prefix for each id hold what
+// Postgres does, and reports the lists only the cache has.
+func warmLists(prefix string, stored map[string][]string, kind string, report *warmupReport) (err error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	for id, values := range stored {
+		var cached []string
+		if cached, err = rangeCached(prefix + id); err != nil {
+			return
+		}
+		if sameStrings(cached, values) {
+			continue
+		}
+		if len(cached) > 0 {
+			report.inconsistent(kind, log.Fields{"ID": id, "cache": len(cached), "postgres": len(values)})
+			if _, err = conn.Do("DEL", prefix+id); err != nil {
+				return
+			}
+		}
+		if err = pushCached(prefix+id, values...); err != nil {
+			return
+		}
+	}
+
+	keys, err := redis.GetKeys(prefix + "*")
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if id := strings.TrimPrefix(key, prefix); stored[id] == nil {
+			report.onlyInCache(kind, log.Fields{"ID": id})
+		}
+	}
+	return
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreCounter makes sure new order or trade ids are issued past every
+// one Postgres knows about, even if the cache lost its counter.
+func restoreCounter(counter string, maxID int, report *warmupReport) (err error) {
+	conn := redis.Pool.Get()
+	defer conn.Close()
+
+	current, err := redigo.Int(conn.Do("GET", counter))
+	if err != nil && err != redigo.ErrNil {
+		return
+	}
+	err = nil
+	if current < maxID {
+		report.inconsistent("counter behind Postgres", log.Fields{"counter": counter, "cache": current, "postgres": maxID})
+		err = redis.Set(counter, maxID)
+	}
+	return
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests are XML or JSON, told apart by their first byte: a JSON request
+// is an object, and anything else is read as XML. Both are decoded to the
+// same request, so the handlers never know which was sent. The response is
+// written in the same encoding, and so are the execution reports of the
+// accounts the request subscribes its connection to.
+//
+// A JSON request names its kind as XML's outer element does, and each
+// command is an object with one member, named for the XML element and
+// holding its attributes:
+//
+//     {"create": [{"account": {"id": "1", "balance": 1000}},
+//                 {"symbol": {"sym": "SPY", "accounts": [{"id": "1", "amount": 100}]}}]}
+//     {"transactions": {"id": "1", "commands": [{"order": {"sym": "SPY", "amount": -100, "limit": 10}},
+//                                               {"query": {"id": "4"}}]}}
+//     {"book": {"sym": "SPY", "depth": 5}}
+//     {"dump": {"token": "...", "table": "position"}}
+//
+// Numbers may be sent as JSON numbers or strings; they are always returned
+// as strings, so no precision is lost. The response is one line holding
+// the XML response's elements in the same shape:
+//
+//     {"results": [{"opened": {"id": "4", "sym": "SPY", "amount": "-100", "limit": "10", "status": "open"}}]}
+
+type wireFormat int
+
+const (
+	formatXML wireFormat = iota
+	formatJSON
+)
+
+// formatOf returns the encoding of a request.
+func formatOf(req []byte) wireFormat {
+	if trimmed := bytes.TrimSpace(req); len(trimmed) > 0 && trimmed[0] == '{' {
+		return formatJSON
+	}
+	return formatXML
+}
+
+// A request, decoded from either encoding
+type request struct {
+	format   wireFormat
+	kind     string    // create, transactions, book or dump; "" if not understood
+	account  string    // whose transactions
+	commands []command // in the order they were sent; a book or dump is its own
+	err      error     // why a JSON request could not be read at all
+}
+
+// One command of a request
+type command struct {
+	name string
+	args interface{}       // an *Order, *Cancel and so on; nil if it did not decode
+	err  error             // why it did not
+	sent map[string]string // its attributes as sent, to echo back when it did not
+}
+
+// The commands each kind of request may hold, by name
+var commandArgs = map[string]map[string]func() interface{}{
+	"create": {
+		"account": func() interface{} { return new(Account) },
+		"symbol":  func() interface{} { return new(Symbol) },
+	},
+	"transactions": {
+		"order":     func() interface{} { return new(Order) },
+		"cancel":    func() interface{} { return new(Cancel) },
+		"query":     func() interface{} { return new(Query) },
+		"replace":   func() interface{} { return new(Replace) },
+		"subscribe": func() interface{} { return new(Subscribe) },
+		"balance":   func() interface{} { return new(Balance) },
+		"positions": func() interface{} { return new(Positions) },
+		"orders":    func() interface{} { return new(Orders) },
+	},
+	"book": {"book": func() interface{} { return new(Book) }},
+	"dump": {"dump": func() interface{} { return new(Dump) }},
+}
+
+// decodeRequest decodes a request in whichever encoding it was sent.
+func decodeRequest(req []byte) *request {
+	if formatOf(req) == formatJSON {
+		return decodeJSON(req)
+	}
+	return decodeXML(req)
+}
+
+// decodeXML reads the first request element of req. Anything it doesn't
+// know is skipped.
+func decodeXML(req []byte) (r *request) {
+	r = &request{format: formatXML}
+	decoder := xml.NewDecoder(bytes.NewReader(req))
+	for {
+		token, _ := decoder.Token()
+		if token == nil {
+			return
+		}
+		se, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		args, ok := commandArgs[se.Name.Local]
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "transactions":
+			r.account = attr(se, "id")
+			if r.account == "" {
+				log.Error("Did not supply ID to perform transactions on")
+				continue
+			}
+			fallthrough
+		case "create":
+			r.kind = se.Name.Local
+			r.commands = decodeXMLCommands(decoder, se.Name.Local, args)
+		default:
+			r.kind = se.Name.Local
+			r.commands = []command{decodeXMLCommand(decoder, se, args[se.Name.Local]())}
+		}
+		return
+	}
+}
+
+// decodeXMLCommands reads the commands inside a <create> or <transactions>,
+// in order.
+func decodeXMLCommands(decoder *xml.Decoder, kind string, args map[string]func() interface{}) (commands []command) {
+	for {
+		token, _ := decoder.Token()
+		if token == nil {
+			return
+		}
+		switch se := token.(type) {
+		case xml.StartElement:
+			newArgs, ok := args[se.Name.Local]
+			if !ok {
+				decoder.Skip()
+				continue
+			}
+			commands = append(commands, decodeXMLCommand(decoder, se, newArgs()))
+		case xml.EndElement:
+			if se.Name.Local == kind {
+				return
+			}
+		}
+	}
+}
+
+func decodeXMLCommand(decoder *xml.Decoder, se xml.StartElement, args interface{}) command {
+	c := command{name: se.Name.Local, args: args}
+	if c.err = decoder.DecodeElement(args, &se); c.err != nil {
+		c.args = nil
+		c.sent = make(map[string]string)
+		for _, a := range se.Attr {
+			c.sent[a.Name.Local] = a.Value
+		}
+	}
+	return c
+}
+
+func attr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// decodeJSON reads a JSON request. Unlike XML, anything it doesn't know is
+// an error, since JSON clients are told rather than ignored.
+func decodeJSON(req []byte) (r *request) {
+	r = &request{format: formatJSON}
+	var outer map[string]json.RawMessage
+	if r.err = json.Unmarshal(req, &outer); r.err != nil {
+		return
+	}
+	if len(outer) != 1 {
+		r.err = fmt.Errorf("A request is one of create, transactions, book or dump")
+		return
+	}
+
+	for kind, body := range outer {
+		args, ok := commandArgs[kind]
+		if !ok {
+			r.err = fmt.Errorf("Unknown request %s", kind)
+			return
+		}
+		r.kind = kind
+
+		switch kind {
+		case "create":
+			var commands []map[string]json.RawMessage
+			if r.err = json.Unmarshal(body, &commands); r.err == nil {
+				r.commands = decodeJSONCommands(commands, args)
+			}
+		case "transactions":
+			var trans struct {
+				Id       string                       `json:"id"`
+				Commands []map[string]json.RawMessage `json:"commands"`
+			}
+			if r.err = json.Unmarshal(body, &trans); r.err == nil && trans.Id == "" {
+				r.err = fmt.Errorf("Did not supply ID to perform transactions on")
+			}
+			if r.err == nil {
+				r.account = trans.Id
+				r.commands = decodeJSONCommands(trans.Commands, args)
+			}
+		default:
+			r.commands = decodeJSONCommands([]map[string]json.RawMessage{outer}, args)
+		}
+	}
+	return
+}
+
+func decodeJSONCommands(commands []map[string]json.RawMessage, args map[string]func() interface{}) (decoded []command) {
+	for _, members := range commands {
+		if len(members) != 1 {
+			decoded = append(decoded, command{err: fmt.Errorf("A command has exactly one member, its name")})
+			continue
+		}
+		for name, body := range members {
+			newArgs, ok := args[name]
+			if !ok {
+				decoded = append(decoded, command{err: fmt.Errorf("Unknown command %s", name)})
+				continue
+			}
+			c := command{name: name, args: newArgs()}
+			if c.err = json.Unmarshal(body, c.args); c.err != nil {
+				c.args = nil
+				c.sent = sentMembers(body)
+			}
+			decoded = append(decoded, c)
+		}
+	}
+	return
+}
+
+// sentMembers returns the members of a JSON object as text, as they were
+// sent.
+func sentMembers(body json.RawMessage) map[string]string {
+	sent := make(map[string]string)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var members map[string]interface{}
+	if decoder.Decode(&members) == nil {
+		for name, value := range members {
+			sent[name] = fmt.Sprint(value)
+		}
+	}
+	return sent
+}
+
+// elements are responses, each written as its own XML element, or in JSON
+// as an object with one member named for it.
+type elements []interface{}
+
+func (e elements) MarshalJSON() ([]byte, error) {
+	named := make([]map[string]interface{}, 0, len(e)) // [] rather than null when empty
+	for _, v := range e {
+		named = append(named, map[string]interface{}{elementName(v): v})
+	}
+	return json.Marshal(named)
+}
+
+// elementName returns the name of the XML element v is written as.
+func elementName(v interface{}) string {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	field, ok := value.Type().FieldByName("XMLName")
+	if !ok {
+		return value.Type().Name()
+	}
+	if name := value.FieldByIndex(field.Index).Interface().(xml.Name); name.Local != "" {
+		return name.Local
+	}
+	return strings.Split(field.Tag.Get("xml"), ",")[0]
+}
+
+// The items of a status or cancel are its whole value in JSON.
+func (s StatusResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Items)
+}
+
+func (c CancelResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.Items)
+}
+
+// A level's side is its element name in XML and a member in JSON.
+func (l MarketDataLevel) MarshalJSON() ([]byte, error) {
+	type level MarketDataLevel // without this method
+	return json.Marshal(struct {
+		Side string `json:"side"`
+		level
+	}{l.XMLName.Local, level(l)})
+}
+
+// A row is an object of its columns, in order.
+func (r DumpRowResponse) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, column := range r.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(column.Name.Local)
+		value, _ := json.Marshal(column.Value)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// encode writes one message, such as an execution report, on its own.
+func (f wireFormat) encode(v interface{}) ([]byte, error) {
+	var message []byte
+	var err error
+	if f == formatJSON {
+		message, err = json.Marshal(map[string]interface{}{elementName(v): v})
+	} else {
+		message, err = xml.MarshalIndent(v, "", "    ")
+	}
+	return append(message, '\n'), err
+}
+
+// results writes the response to a request: every command's, in order,
+// or nothing if the request was not understood at all.
+func (f wireFormat) results(resps elements) string {
+	if resps == nil {
+		return ""
+	}
+	if f == formatJSON {
+		results, err := json.Marshal(map[string]elements{"results": resps})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to encode results")
+		}
+		return string(results) + "\n"
+	}
+
+	results := "<results>\n"
+	for _, resp := range resps {
+		if resp_string, err := xml.MarshalIndent(resp, "", "    "); err == nil {
+			results += string(resp_string) + "\n"
+		}
+	}
+	return results + "</results>\n"
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// The same transactions in both encodings decode to the same request.
+func TestDecodeXMLAndJSONAlike(t *testing.T) {
+	requests := []string{
+		`<?xml version="1.0" encoding="UTF-8"?>
+<transactions id="7">
+	<order sym="SPY" amount="-100" limit="145.67"/>
+	<unknown/>
+	<query id="3"/>
+	<cancel id="4"/>
+</transactions>`,
+		` {"transactions": {"id": "7", "commands": [
+			{"order": {"sym": "SPY", "amount": -100, "limit": "145.67"}},
+			{"query": {"id": "3"}},
+			{"cancel": {"id": "4"}}]}}`,
+	}
+	for i, req := range requests {
+		r := decodeRequest([]byte(req))
+		if r.format != wireFormat(i) || r.err != nil {
+			t.Fatalf("%d: format %v, error %v", i, r.format, r.err)
+		}
+		if r.kind != "transactions" || r.account != "7" || len(r.commands) != 3 {
+			t.Fatalf("%d: %+v", i, r)
+		}
+		order, ok := r.commands[0].args.(*Order)
+		if !ok || order.Sym != "SPY" || order.Amount.String() != "-100" || order.Limit.String() != "145.67" {
+			t.Errorf("%d: order %+v", i, r.commands[0])
+		}
+		if q, ok := r.commands[1].args.(*Query); !ok || q.TransactionID != "3" {
+			t.Errorf("%d: query %+v", i, r.commands[1])
+		}
+		if c, ok := r.commands[2].args.(*Cancel); !ok || c.TransactionID != "4" {
+			t.Errorf("%d: cancel %+v", i, r.commands[2])
+		}
+	}
+}
+
+func TestDecodeCreate(t *testing.T) {
+	r := decodeRequest([]byte(`<create><account id="1" balance="1000.5"/><symbol sym="SPY"><account id="1">100</account></symbol></create>`))
+	if r.kind != "create" || len(r.commands) != 2 {
+		t.Fatalf("%+v", r)
+	}
+	if a, ok := r.commands[0].args.(*Account); !ok || a.Id != "1" || a.Balance.String() != "1000.5" {
+		t.Errorf("account %+v", r.commands[0])
+	}
+	s, ok := r.commands[1].args.(*Symbol)
+	if !ok || s.Sym != "SPY" || len(s.Accounts) != 1 || s.Accounts[0].Amount.String() != "100" {
+		t.Errorf("symbol %+v", r.commands[1])
+	}
+}
+
+// A command that does not parse keeps what was sent, to echo back.
+func TestDecodeBadCommand(t *testing.T) {
+	requests := []string{
+		`<transactions id="7"><order sym="SPY" amount="ten" limit="1"/></transactions>`,
+		`{"transactions": {"id": "7", "commands": [{"order": {"sym": "SPY", "amount": "ten", "limit": 1}}]}}`,
+	}
+	for _, req := range requests {
+		r := decodeRequest([]byte(req))
+		if len(r.commands) != 1 {
+			t.Fatalf("%s: %+v", req, r)
+		}
+		c := r.commands[0]
+		if c.args != nil || c.err == nil || c.sent["amount"] != "ten" || c.sent["limit"] != "1" {
+			t.Errorf("%s: %+v", req, c)
+		}
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		req    string
+		reason string // of the request, or of its first command
+	}{
+		{`{"transactions": `, "unexpected end of JSON input"},
+		{`{"create": [], "book": {}}`, "A request is one of create, transactions, book or dump"},
+		{`{"trade": {}}`, "Unknown request trade"},
+		{`{"transactions": {"commands": []}}`, "Did not supply ID to perform transactions on"},
+		{`{"transactions": {"id": "1", "commands": [{"trade": {}}]}}`, "Unknown command trade"},
+		{`{"create": [{"account": {}, "symbol": {}}]}`, "A command has exactly one member, its name"},
+		{`{"book": {"sym": "SPY", "depth": 1.5e3}}`, ""},
+	}
+	for _, test := range tests {
+		r := decodeRequest([]byte(test.req))
+		err := r.err
+		if err == nil && len(r.commands) > 0 {
+			err = r.commands[0].err
+		}
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.reason {
+			t.Errorf("%s: got %q, want %q", test.req, got, test.reason)
+		}
+	}
+}
+
+// Reasons are text even when they hold what a client sent.
+func TestErrorReasonEscaped(t *testing.T) {
+	resp := ErrorTransResponse{Sym: "SPY", Amount: "1", Reason: "Unknown command </error><x>&"}
+	out, err := xml.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back ErrorTransResponse
+	if err = xml.Unmarshal(out, &back); err != nil || back.Reason != resp.Reason {
+		t.Errorf("%s read back as %q, %v", out, back.Reason, err)
+	}
+}
+
+func TestResultsInEitherFormat(t *testing.T) {
+	resps := elements{
+		OpenResponse{TransactionID: "1", Sym: "SPY", Amount: dec(t, "-10"), Limit: decp(t, "12.5")},
+		StatusResponse{Items: elements{OpenQueryResponse{Shares: dec(t, "-10")}}},
+	}
+
+	var decoded struct {
+		Results []map[string]json.RawMessage `json:"results"`
+	}
+	out := formatJSON.results(resps)
+	if !strings.HasSuffix(out, "\n") || strings.Count(out, "\n") != 1 {
+		t.Errorf("JSON results are not one line: %q", out)
+	}
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Results) != 2 || string(decoded.Results[1]["status"]) != `[{"open":{"shares":"-10"}}]` {
+		t.Errorf("JSON results %s", out)
+	}
+	if opened := string(decoded.Results[0]["opened"]); opened != `{"id":"1","sym":"SPY","amount":"-10","limit":"12.5"}` {
+		t.Errorf("opened %s", opened)
+	}
+
+	out = formatXML.results(resps)
+	if !strings.HasPrefix(out, "<results>\n") || !strings.Contains(out, `<opened id="1" sym="SPY" amount="-10" limit="12.5"></opened>`) {
+		t.Errorf("XML results %s", out)
+	}
+	if formatXML.results(nil) != "" || formatJSON.results(nil) != "" {
+		t.Error("a request not understood should get no response")
+	}
+}
@@ -1,95 +1,312 @@
 package main
 
 import (
-  "encoding/xml"
+	"encoding/json"
+	"encoding/xml"
+
+	"github.com/farice/EME/decimal"
 )
+
 // Remember to capitalize field names so they are exported
 
 type Account struct {
-	XMLName xml.Name `xml:"account"`
-	Id      string   `xml:"id,attr"`
-	Balance string   `xml:"balance,attr"`
+	XMLName xml.Name        `xml:"account" json:"-"`
+	Id      string          `xml:"id,attr" json:"id"`
+	Balance decimal.Decimal `xml:"balance,attr" json:"balance"`
+	Stp     string          `xml:"stp,attr" json:"stp"` // default self-trade prevention for the account's orders
 }
 
 type Dump struct {
-  XMLName xml.Name `xml:"dump"`
+	XMLName xml.Name    `xml:"dump" json:"-"`
+	Token   string      `xml:"token,attr" json:"token"` // the admin token
+	Table   string      `xml:"table,attr" json:"table"` // every table if left out
+	Account string      `xml:"account,attr" json:"account"`
+	Symbol  string      `xml:"symbol,attr" json:"symbol"`
+	Limit   json.Number `xml:"limit,attr" json:"limit"` // rows a table
+	After   string      `xml:"after,attr" json:"after"` // a table's next, for the page after
 }
 
 type Symbol struct {
-	XMLName  xml.Name `xml:"symbol"`
-	Sym      string   `xml:"sym,attr"`
+	XMLName  xml.Name `xml:"symbol" json:"-"`
+	Sym      string   `xml:"sym,attr" json:"sym"`
 	Accounts []struct {
-		Id     string `xml:"id,attr"`
-		Amount string `xml:",innerxml"`
-	} `xml:"account"`
+		Id     string          `xml:"id,attr" json:"id"`
+		Amount decimal.Decimal `xml:",chardata" json:"amount"`
+	} `xml:"account" json:"accounts"`
 }
 
 type Order struct {
-	XMLName xml.Name `xml:"order"`
-	Sym     string   `xml:"sym,attr"`
-	Amount  string   `xml:"amount,attr"` // negative means to sell
-	Limit   string   `xml:"limit,attr"`
+	XMLName xml.Name         `xml:"order" json:"-"`
+	Sym     string           `xml:"sym,attr" json:"sym"`
+	Amount  decimal.Decimal  `xml:"amount,attr" json:"amount"`   // negative means to sell
+	Limit   *decimal.Decimal `xml:"limit,attr" json:"limit"`     // nil for market orders
+	Type    string           `xml:"type,attr" json:"type"`       // "limit" (default) or "market"
+	Tif     string           `xml:"tif,attr" json:"tif"`         // GTC (default), GTD, IOC or FOK
+	Expires string           `xml:"expires,attr" json:"expires"` // GTD only: RFC 3339 or epoch seconds
+	Stp     string           `xml:"stp,attr" json:"stp"`         // self-trade prevention, the account's if left out
 }
 
 type Cancel struct {
-	XMLName       xml.Name `xml:"cancel"`
-	TransactionID string   `xml:"id,attr"`
+	XMLName       xml.Name `xml:"cancel" json:"-"`
+	TransactionID string   `xml:"id,attr" json:"id"`
+}
+
+type Replace struct {
+	XMLName       xml.Name         `xml:"replace" json:"-"`
+	TransactionID string           `xml:"id,attr" json:"id"`
+	Amount        *decimal.Decimal `xml:"amount,attr" json:"amount"` // new open amount, same sign as the order
+	Limit         *decimal.Decimal `xml:"limit,attr" json:"limit"`
+}
+
+type Subscribe struct {
+	XMLName xml.Name `xml:"subscribe" json:"-"`
+}
+
+type Book struct {
+	XMLName xml.Name    `xml:"book" json:"-"`
+	Sym     string      `xml:"sym,attr" json:"sym"`
+	Depth   json.Number `xml:"depth,attr" json:"depth"` // price levels a side, every one if left out
+}
+
+type Balance struct {
+	XMLName xml.Name `xml:"balance" json:"-"`
+}
+
+type Positions struct {
+	XMLName xml.Name `xml:"positions" json:"-"`
+}
+
+type Orders struct {
+	XMLName xml.Name `xml:"orders" json:"-"`
+	Status  string   `xml:"status,attr" json:"status"` // "open" (default) or "all"
 }
 
 type Query struct {
-	XMLName       xml.Name `xml:"query"`
-	TransactionID string   `xml:"id,attr"`
+	XMLName       xml.Name `xml:"query" json:"-"`
+	TransactionID string   `xml:"id,attr" json:"id"`
+}
+
+// An order's history, as <query> returns it
+type StatusResponse struct {
+	XMLName xml.Name `xml:"status" json:"-"`
+	Items   elements // fills, self-trade cancels, then what is open or canceled; or an error
+}
+
+// What is left of an order once <cancel> has canceled it
+type CancelResponse struct {
+	XMLName xml.Name `xml:"canceled" json:"-"`
+	Items   elements // as in StatusResponse
 }
 
 type OpenQueryResponse struct {
-	XMLName xml.Name `xml:"open"`
-	Shares string   `xml:"shares,attr"`
+	XMLName xml.Name        `xml:"open" json:"-"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"`
 }
 
 type CancelQueryResponse struct {
-	XMLName xml.Name `xml:"canceled"`
-	Shares string   `xml:"shares,attr"`
-	Time string `xml:"time,attr"`
+	XMLName xml.Name        `xml:"canceled" json:"-"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"`
+	Time    string          `xml:"time,attr" json:"time"`
+	Reason  string          `xml:"reason,attr,omitempty" json:"reason,omitempty"` // "self-trade" if canceled to prevent one
 }
 
 type ExecutedQueryResponse struct {
-	XMLName xml.Name `xml:"executed"`
-	Shares string   `xml:"shares,attr"`
-	Price string   `xml:"price,attr"`
-	Time string `xml:"time,attr"`
+	XMLName xml.Name        `xml:"executed" json:"-"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"`
+	Price   decimal.Decimal `xml:"price,attr" json:"price"`
+	Time    string          `xml:"time,attr" json:"time"`
+}
+
+// Pushed, unrequested, when one of a subscribed account's resting orders fills
+type ExecutionReport struct {
+	XMLName       xml.Name        `xml:"executed" json:"-"`
+	TransactionID string          `xml:"id,attr" json:"id"`
+	Sym           string          `xml:"sym,attr" json:"sym"`
+	Shares        decimal.Decimal `xml:"shares,attr" json:"shares"` // negative for sells
+	Price         decimal.Decimal `xml:"price,attr" json:"price"`
+	Remaining     decimal.Decimal `xml:"remaining,attr" json:"remaining"` // still open, negative for sells
+	Time          string          `xml:"time,attr" json:"time"`
+}
+
+type SubscribedResponse struct {
+	XMLName xml.Name `xml:"subscribed" json:"-"`
+	Id      string   `xml:"id,attr" json:"id"`
+}
+
+type MarketDataRequest struct {
+	XMLName xml.Name `json:"-"` // subscribe or unsubscribe
+	Sym     string   `xml:"sym,attr" json:"sym"`
+}
+
+type MarketDataTrade struct {
+	XMLName xml.Name        `xml:"trade" json:"-"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"`
+	Price   decimal.Decimal `xml:"price,attr" json:"price"`
+	Time    string          `xml:"time,attr" json:"time"`
+}
+
+// Every order resting at one price on one side of a book, added up
+type MarketDataLevel struct {
+	XMLName xml.Name        `json:"-"` // bid or ask
+	Price   decimal.Decimal `xml:"price,attr" json:"price"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"` // 0 when the level is gone
+	Orders  int             `xml:"orders,attr" json:"orders"`
+}
+
+// Best bid and ask, each left out while its side is empty
+type MarketDataQuote struct {
+	XMLName   xml.Name         `xml:"quote" json:"-"`
+	Bid       *decimal.Decimal `xml:"bid,attr,omitempty" json:"bid,omitempty"`
+	BidShares *decimal.Decimal `xml:"bidshares,attr,omitempty" json:"bidshares,omitempty"`
+	Ask       *decimal.Decimal `xml:"ask,attr,omitempty" json:"ask,omitempty"`
+	AskShares *decimal.Decimal `xml:"askshares,attr,omitempty" json:"askshares,omitempty"`
+}
+
+type MarketDataSnapshot struct {
+	XMLName xml.Name          `xml:"snapshot" json:"-"`
+	Sym     string            `xml:"sym,attr" json:"sym"`
+	Seq     uint64            `xml:"seq,attr" json:"seq"`
+	Trade   *MarketDataTrade  `json:"trade,omitempty"` // the last, if any
+	Quote   MarketDataQuote   `json:"quote"`
+	Levels  []MarketDataLevel `json:"levels,omitempty"`
+}
+
+// What changed in a book since the update before it
+type MarketDataUpdate struct {
+	XMLName xml.Name          `xml:"update" json:"-"`
+	Sym     string            `xml:"sym,attr" json:"sym"`
+	Seq     uint64            `xml:"seq,attr" json:"seq"`
+	Trades  []MarketDataTrade `json:"trades,omitempty"` // in the order they happened
+	Quote   *MarketDataQuote  `json:"quote,omitempty"`  // only if it changed
+	Levels  []MarketDataLevel `json:"levels,omitempty"` // only those that changed
+
+	bids, asks []depthLevel // the whole book afterwards
+}
+
+type UnsubscribedResponse struct {
+	XMLName xml.Name `xml:"unsubscribed" json:"-"`
+	Sym     string   `xml:"sym,attr" json:"sym"`
 }
 
 type OpenResponse struct {
-	XMLName       xml.Name `xml:"opened"`
-	TransactionID string   `xml:"id,attr"`
-	Sym           string   `xml:"sym,attr"`
-	Amount        string   `xml:"amount,attr"` // negative means to sell
-	Limit         string   `xml:"limit,attr"`
+	XMLName       xml.Name            `xml:"opened" json:"-"`
+	TransactionID string              `xml:"id,attr" json:"id"`
+	Sym           string              `xml:"sym,attr" json:"sym"`
+	Amount        decimal.Decimal     `xml:"amount,attr" json:"amount"` // negative means to sell
+	Limit         *decimal.Decimal    `xml:"limit,attr,omitempty" json:"limit,omitempty"`
+	Type          string              `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Tif           string              `xml:"tif,attr,omitempty" json:"tif,omitempty"`
+	Expires       string              `xml:"expires,attr,omitempty" json:"expires,omitempty"`
+	Status        string              `xml:"status,attr,omitempty" json:"status,omitempty"`     // filled, open, canceled or killed
+	Canceled      *decimal.Decimal    `xml:"canceled,attr,omitempty" json:"canceled,omitempty"` // shares that did not fill and will not rest
+	Stp           string              `xml:"stp,attr,omitempty" json:"stp,omitempty"`
+	SelfTrades    []SelfTradeResponse `json:"selftrades,omitempty"`
+}
+
+// Shares of an order, this one or a resting one of the same account,
+// canceled to prevent a self-trade
+type SelfTradeResponse struct {
+	XMLName       xml.Name        `xml:"selftrade" json:"-"`
+	TransactionID string          `xml:"id,attr" json:"id"`
+	Canceled      decimal.Decimal `xml:"canceled,attr" json:"canceled"` // negative for sells
+}
+
+// A book's open orders by price level, bids then asks, best first
+type BookResponse struct {
+	XMLName xml.Name          `xml:"book" json:"-"`
+	Sym     string            `xml:"sym,attr" json:"sym"`
+	Levels  []MarketDataLevel `json:"levels,omitempty"`
+}
+
+// The account's cash; what is reserved for resting buys is part of the
+// total but not available
+type BalanceResponse struct {
+	XMLName   xml.Name        `xml:"balance" json:"-"`
+	Total     decimal.Decimal `xml:"total,attr" json:"total"`
+	Available decimal.Decimal `xml:"available,attr" json:"available"`
+	Reserved  decimal.Decimal `xml:"reserved,attr" json:"reserved"`
+}
+
+type PositionsResponse struct {
+	XMLName   xml.Name           `xml:"positions" json:"-"`
+	Positions []PositionResponse `json:"positions,omitempty"`
+}
+
+// Shares held, not counting those offered by resting sells
+type PositionResponse struct {
+	XMLName xml.Name        `xml:"position" json:"-"`
+	Sym     string          `xml:"sym,attr" json:"sym"`
+	Shares  decimal.Decimal `xml:"shares,attr" json:"shares"`
+}
+
+type OrdersResponse struct {
+	XMLName xml.Name        `xml:"orders" json:"-"`
+	Status  string          `xml:"status,attr" json:"status"`
+	Orders  []OrderResponse `json:"orders,omitempty"`
+}
+
+type OrderResponse struct {
+	XMLName       xml.Name         `xml:"order" json:"-"`
+	TransactionID string           `xml:"id,attr" json:"id"`
+	Sym           string           `xml:"sym,attr" json:"sym"`
+	Amount        decimal.Decimal  `xml:"amount,attr" json:"amount"`                   // as placed, negative means to sell
+	Limit         *decimal.Decimal `xml:"limit,attr,omitempty" json:"limit,omitempty"` // current, none for market orders
+	Remaining     decimal.Decimal  `xml:"remaining,attr" json:"remaining"`
+	Status        string           `xml:"status,attr" json:"status"` // open, filled or canceled
+}
+
+type DumpResponse struct {
+	XMLName xml.Name            `xml:"dump" json:"-"`
+	Tables  []DumpTableResponse `json:"tables,omitempty"`
+}
+
+type DumpTableResponse struct {
+	XMLName xml.Name          `xml:"table" json:"-"`
+	Name    string            `xml:"name,attr" json:"name"`
+	Next    string            `xml:"next,attr,omitempty" json:"next,omitempty"` // cursor of the next page, if there is one
+	Rows    []DumpRowResponse `json:"rows,omitempty"`
+}
+
+// A row, one attribute a column
+type DumpRowResponse struct {
+	XMLName xml.Name   `xml:"row" json:"-"`
+	Columns []xml.Attr `xml:",any,attr"` // written as an object in JSON
+}
+
+type ReplacedResponse struct {
+	XMLName       xml.Name            `xml:"replaced" json:"-"`
+	TransactionID string              `xml:"id,attr" json:"id"`
+	Sym           string              `xml:"sym,attr" json:"sym"`
+	Amount        decimal.Decimal     `xml:"amount,attr" json:"amount"` // left open after any trades the new limit caused
+	Limit         decimal.Decimal     `xml:"limit,attr" json:"limit"`
+	Priority      string              `xml:"priority,attr" json:"priority"` // "kept" or "lost" time priority
+	SelfTrades    []SelfTradeResponse `json:"selftrades,omitempty"`
+	Fills         []ExecutionReport   `json:"fills,omitempty"` // trades the new limit caused
 }
 
 type ErrorTransResponse struct {
-	XMLName xml.Name `xml:"error"`
-	Sym     string   `xml:"sym,attr"`
-	Amount  string   `xml:"amount,attr"` // negative means to sell
-	Limit   string   `xml:"limit,attr"`
-	Reason  string   `xml:",innerxml"`
+	XMLName xml.Name `xml:"error" json:"-"`
+	Sym     string   `xml:"sym,attr" json:"sym"`
+	Amount  string   `xml:"amount,attr" json:"amount"` // negative means to sell
+	Limit   string   `xml:"limit,attr,omitempty" json:"limit,omitempty"`
+	Reason  string   `xml:",chardata" json:"reason"`
 }
 
 type CreatedResponse struct {
-	XMLName xml.Name `xml:"created"`
-	Sym     string   `xml:"sym,attr,omitempty"`
-	Id      string   `xml:"id,attr,omitempty"`
+	XMLName xml.Name `xml:"created" json:"-"`
+	Sym     string   `xml:"sym,attr,omitempty" json:"sym,omitempty"`
+	Id      string   `xml:"id,attr,omitempty" json:"id,omitempty"`
 }
 
 type ErrorCreateResponse struct {
-	XMLName xml.Name `xml:"error"`
-	Sym     string   `xml:"sym,attr,omitempty"`
-	Id      string   `xml:"id,attr,omitempty"`
-	Reason  string   `xml:",innerxml"`
+	XMLName xml.Name `xml:"error" json:"-"`
+	Sym     string   `xml:"sym,attr,omitempty" json:"sym,omitempty"`
+	Id      string   `xml:"id,attr,omitempty" json:"id,omitempty"`
+	Reason  string   `xml:",chardata" json:"reason"`
 }
 
 type ErrorQueryCancelResponse struct {
-  XMLName xml.Name `xml:"error"`
-  TransactionID string   `xml:"id,attr"`
-  Reason  string   `xml:",innerxml"`
+	XMLName       xml.Name `xml:"error" json:"-"`
+	TransactionID string   `xml:"id,attr" json:"id"`
+	Reason        string   `xml:",chardata" json:"reason"`
 }
@@ -12,17 +12,19 @@ var (
     Pool *redis.Pool
 )
 
-func init() {
-    redisHost := "redis:6379"
-    Pool = newPool(redisHost)
+// Init connects the pool to the Redis server at host ("host:port"), keeping
+// up to maxIdle idle connections. It must be called before anything else in
+// this package is used.
+func Init(host string, maxIdle int) {
+    Pool = newPool(host, maxIdle)
     cleanupHook()
 }
 
-func newPool(server string) *redis.Pool {
+func newPool(server string, maxIdle int) *redis.Pool {
 
     return &redis.Pool{
 
-        MaxIdle:     3,
+        MaxIdle:     maxIdle,
         IdleTimeout: 240 * time.Second,
 
         Dial: func() (redis.Conn, error) {
@@ -102,9 +102,23 @@ bool
   return err
 }
 
+// Sets field in the hash stored at key to value only if field does not
+// exist yet. Returns whether it was set.
+func SetFieldNX(key string, field string, value interface{}) (bool, error) {
+
+  conn := Pool.Get()
+  defer conn.Close()
+
+  set, err := redis.Bool(conn.Do("HSETNX", key, field, value))
+  if err != nil {
+    return false, fmt.Errorf("error setting key %s: %v", key, err)
+  }
+  return set, nil
+}
+
 // Every member of a Sorted Set is associated with score, that is used in order to take the sorted set ordered,
 // from the smallest to the greatest score. While members are unique, scores may be repeated.
-func Zadd(setName string, score string, member string) (error) {
+func Zadd(setName string, score int64, member string) (error) {
   conn := Pool.Get()
   defer conn.Close()
 
@@ -197,11 +211,11 @@ func Incr(counterKey string) (int, error) {
 }
 
 //Increment the specified field of a hash stored at key,
-// and representing a floating point number, by the specified increment
-func HIncrByFloat(counterKey string, field string, by float64) (interface{}, error) {
+// and representing an integer, by the specified increment
+func HIncrBy(counterKey string, field string, by int64) (int64, error) {
 
   conn := Pool.Get()
   defer conn.Close()
 
-  return conn.Do("HINCRBYFLOAT", counterKey, field, by)
+  return redis.Int64(conn.Do("HINCRBY", counterKey, field, by))
 }
@@ -0,0 +1,73 @@
+#!/usr/bin/env bash
+
+# Pushes account ids and symbols written as SQL injections through the
+# exchange and checks that Postgres stores them as plain values.
+#
+#     ./hostile.sh [host] [port]
+#
+# Needs psql access to the exchange database; set PSQL to override the
+# default of running it inside the compose db service.
+
+HOST=${1:-localhost}
+PORT=${2:-12345}
+PSQL=${PSQL:-"docker-compose exec -T db psql -U postgres -d exchange -tA"}
+
+RUN=$(date +%s%N | tail -c 10)
+SYM="X$RUN'); DROP TABLE account;--"
+ACCT="h$RUN' OR '1'='1"
+OTHER="h$RUN'; UPDATE account SET balance=0;--"
+
+send() {
+  local body="<?xml version=\"1.0\" encoding=\"UTF-8\"?>
+$1"
+  printf '%d\n%s' "${#body}" "$body" | nc -q 1 "$HOST" "$PORT"
+}
+
+sql() {
+  $PSQL -c "$1"
+}
+
+# Requests reach Postgres once the buffer holds 30 of them, so push
+# filler requests through until everything before them is applied.
+flush() {
+  for i in $(seq 31); do
+    send "<create><account id=\"hf$RUN-$i\" balance=\"0\"/></create>" > /dev/null
+  done
+}
+
+send "<create>
+ <account id=\"$ACCT\" balance=\"1000\"/>
+ <account id=\"$OTHER\" balance=\"500\"/>
+ <symbol sym=\"$SYM\"><account id=\"$OTHER\">10</account></symbol>
+</create>"
+send "<transactions id=\"$OTHER\"><order sym=\"$SYM\" amount=\"-4\" limit=\"5\"/></transactions>"
+send "<transactions id=\"$ACCT\"><order sym=\"$SYM\" amount=\"2\" limit=\"5\"/></transactions>"
+flush
+
+failures=0
+expect() {
+  if [ "$2" == "$3" ]; then
+    echo "ok   $1"
+  else
+    echo "FAIL $1: got '$2', want '$3'"
+    failures=$((failures + 1))
+  fi
+}
+
+# quote for the checks below, which are ours and not parameterized
+q() {
+  printf "%s" "$1" | sed "s/'/''/g"
+}
+
+expect "account table survives" "$(sql "SELECT count(*) > 0 FROM account")" "t"
+expect "symbol stored verbatim" "$(sql "SELECT count(*) FROM symbol WHERE name='$(q "$SYM")'")" "1"
+expect "buyer balance" "$(sql "SELECT balance::float FROM account WHERE uid='$(q "$ACCT")'")" "990"
+expect "seller balance" "$(sql "SELECT balance::float FROM account WHERE uid='$(q "$OTHER")'")" "510"
+expect "buyer position" "$(sql "SELECT amount::float FROM position WHERE account_id='$(q "$ACCT")' AND symbol='$(q "$SYM")'")" "2"
+expect "resting sell" "$(sql "SELECT amount::float FROM sell_order WHERE account_id='$(q "$OTHER")'")" "-2"
+
+if [ $failures -gt 0 ]; then
+  echo "$failures injection checks failed"
+  exit 1
+fi
+echo "hostile ids and symbols stored as plain values"
@@ -0,0 +1,208 @@
+package main
+
+// Checks that JSON requests are handled like their XML equivalents: each
+// request is answered in the encoding it was sent in, even on a connection
+// that uses both, and fills of resting orders are reported in the encoding
+// of the request that opened them.
+//
+//     go run json.go [host:port]
+//
+// Every run uses fresh account ids and a fresh symbol so it can be repeated
+// against a live exchange.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var failures = 0
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// A connection kept open so that reports pushed to it can be read
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	return &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *client) send(body string) {
+	fmt.Fprintf(c.conn, "%d\n%s", len(body), body)
+}
+
+// line reads the next line, waiting at most a few seconds.
+func (c *client) line() string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, _ := c.reader.ReadString('\n')
+	return line
+}
+
+// An element of a JSON response: one member, named as the XML element is
+type element map[string]json.RawMessage
+
+func (e element) name() string {
+	for name := range e {
+		return name
+	}
+	return ""
+}
+
+// get decodes the element's value into v, if it is named name.
+func (e element) get(name string, v interface{}) bool {
+	body, ok := e[name]
+	return ok && json.Unmarshal(body, v) == nil
+}
+
+// transact sends a JSON request and returns the elements of its response.
+func (c *client) transact(request string) []element {
+	c.send(request)
+	line := c.line()
+	var resp struct {
+		Results []element `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(line), &resp); err != nil {
+		failures++
+		fmt.Printf("FAIL response to %s is not JSON: %q\n", request, line)
+	}
+	return resp.Results
+}
+
+func transact(addr string, request string) []element {
+	c := dial(addr)
+	defer c.conn.Close()
+	return c.transact(request)
+}
+
+func names(results []element) (n []string) {
+	for _, e := range results {
+		n = append(n, e.name())
+	}
+	return
+}
+
+func expect(what string, got interface{}, want interface{}) {
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		failures++
+		fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+func main() {
+	addr := "127.0.0.1:12345"
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+	seller, buyer, sym := "js"+run, "jb"+run, "JS"+run
+
+	created := transact(addr, fmt.Sprintf(`{"create": [
+		{"account": {"id": "%s", "balance": 0}},
+		{"account": {"id": "%s", "balance": "1000.000001"}},
+		{"symbol": {"sym": "%s", "accounts": [{"id": "%s", "amount": 100}]}},
+		{"account": {"id": "%s", "balance": 0}}]}`, seller, buyer, sym, seller, seller))
+	expect("create answered in order", names(created), []string{"created", "created", "created", "error"})
+
+	// the seller rests an order over JSON and keeps its connection open
+	sellerConn := dial(addr)
+	defer sellerConn.conn.Close()
+	var opened struct {
+		Id     string `json:"id"`
+		Amount string `json:"amount"`
+		Limit  string `json:"limit"`
+	}
+	resp := sellerConn.transact(fmt.Sprintf(`{"transactions": {"id": "%s", "commands": [{"order": {"sym": "%s", "amount": -40, "limit": "12.5"}}]}}`, seller, sym))
+	expect("order opened", len(resp) == 1 && resp[0].get("opened", &opened), true)
+	expect("numbers come back as strings", opened.Amount+" "+opened.Limit, "-40 12.5")
+
+	// an XML buyer takes part of it, and the seller hears in JSON
+	buyerConn := dial(addr)
+	defer buyerConn.conn.Close()
+	buy := fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="10" limit="13"/></transactions>`, buyer, sym)
+	buyerConn.send(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + buy)
+	xmlResp := ""
+	for !strings.Contains(xmlResp, "</results>") {
+		line := buyerConn.line()
+		if line == "" {
+			break
+		}
+		xmlResp += line
+	}
+	expect("XML request answered in XML", strings.Contains(xmlResp, "<opened "), true)
+
+	var report struct {
+		Id        string `json:"id"`
+		Shares    string `json:"shares"`
+		Price     string `json:"price"`
+		Remaining string `json:"remaining"`
+	}
+	var pushed element
+	json.Unmarshal([]byte(sellerConn.line()), &pushed)
+	expect("fill reported in JSON", pushed.get("executed", &report) && report.Id == opened.Id, true)
+	expect("reported fill", report.Shares+" "+report.Price+" "+report.Remaining, "-10 12.5 -30")
+
+	// the same connection may switch encodings from one request to the next
+	buyerConn.send(fmt.Sprintf(`{"transactions": {"id": "%s", "commands": [{"balance": {}}, {"query": {"id": "%s"}}]}}`, buyer, opened.Id))
+	var inquiry struct {
+		Results []element `json:"results"`
+	}
+	checkError(json.Unmarshal([]byte(buyerConn.line()), &inquiry))
+	var balance struct {
+		Total string `json:"total"`
+	}
+	var status []element
+	expect("inquiries answered", names(inquiry.Results), []string{"balance", "status"})
+	expect("balance kept to the micro-unit", len(inquiry.Results) == 2 && inquiry.Results[0].get("balance", &balance) && balance.Total == "875.000001", true)
+	expect("status of the order", len(inquiry.Results) == 2 && inquiry.Results[1].get("status", &status) && fmt.Sprint(names(status)) == "[executed open]", true)
+
+	var book struct {
+		Levels []struct {
+			Side   string `json:"side"`
+			Price  string `json:"price"`
+			Shares string `json:"shares"`
+		} `json:"levels"`
+	}
+	resp = transact(addr, fmt.Sprintf(`{"book": {"sym": "%s", "depth": 5}}`, sym))
+	expect("book", len(resp) == 1 && resp[0].get("book", &book) && fmt.Sprint(book.Levels) == "[{ask 12.5 30}]", true)
+
+	var canceled []element
+	resp = sellerConn.transact(fmt.Sprintf(`{"transactions": {"id": "%s", "commands": [{"cancel": {"id": "%s"}}]}}`, seller, opened.Id))
+	expect("cancel", len(resp) == 1 && resp[0].get("canceled", &canceled) && fmt.Sprint(names(canceled)) == "[executed canceled]", true)
+
+	var fail struct {
+		Amount string `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	resp = transact(addr, fmt.Sprintf(`{"transactions": {"id": "%s", "commands": [{"order": {"sym": "%s", "amount": "ten", "limit": 1}}, {"trade": {}}]}}`, buyer, sym))
+	expect("bad commands refused", names(resp), []string{"error", "error"})
+	expect("bad order echoed back", len(resp) > 0 && resp[0].get("error", &fail) && fail.Amount == "ten", true)
+
+	resp = transact(addr, `{"transactions": `)
+	expect("malformed JSON refused", names(resp), []string{"error"})
+	resp = transact(addr, `{"dump": {"token": "wrong"}}`)
+	expect("dump still needs the token", len(resp) == 1 && resp[0].get("error", &fail) && fail.Reason == "Not permitted", true)
+
+	if failures > 0 {
+		fmt.Printf("%d JSON checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("JSON requests are handled like XML")
+}
@@ -0,0 +1,242 @@
+package main
+
+// Checks the market data feed: a snapshot on subscribing, then numbered
+// updates that, applied in order, always give the book a fresh snapshot
+// shows, even while many requests change it at once. A <book> request must
+// show the same book.
+//
+//     go run marketdata.go [host:port] [market data host:port]
+//
+// Every run uses a fresh symbol so it can be repeated against a live
+// exchange.
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var failures = 0
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// send frames a request the way the exchange expects it.
+func send(conn net.Conn, request string) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + request
+	fmt.Fprintf(conn, "%d\n%s", len(body), body)
+}
+
+// transact sends one request and reads back its <results> block.
+func transact(addr string, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	defer conn.Close()
+
+	send(conn, request)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp := ""
+	for !strings.Contains(resp, "</results>") {
+		line, err := reader.ReadString('\n')
+		resp += line
+		if err != nil {
+			break
+		}
+	}
+	return resp
+}
+
+type level struct {
+	XMLName xml.Name
+	Price   string `xml:"price,attr"`
+	Shares  string `xml:"shares,attr"`
+	Orders  int    `xml:"orders,attr"`
+}
+
+type trade struct {
+	Shares string `xml:"shares,attr"`
+	Price  string `xml:"price,attr"`
+}
+
+type quote struct {
+	Bid string `xml:"bid,attr"`
+	Ask string `xml:"ask,attr"`
+}
+
+// a <snapshot> or an <update>
+type message struct {
+	XMLName xml.Name
+	Sym     string  `xml:"sym,attr"`
+	Seq     uint64  `xml:"seq,attr"`
+	Trades  []trade `xml:"trade"`
+	Quote   *quote  `xml:"quote"`
+	Levels  []level `xml:",any"`
+}
+
+// A market data subscriber and the book it has been sent
+type subscriber struct {
+	conn    net.Conn
+	decoder *xml.Decoder
+	seq     uint64
+	book    map[string]string // "bid 10" to shares
+	quote   quote
+	trades  []trade
+}
+
+func subscribe(addr string, sym string) *subscriber {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	s := &subscriber{conn: conn, decoder: xml.NewDecoder(conn), book: make(map[string]string)}
+	send(conn, fmt.Sprintf(`<subscribe sym="%s"/>`, sym))
+	snap := s.next()
+	if snap.XMLName.Local != "snapshot" {
+		fmt.Println("Error: expected a snapshot, got", snap.XMLName.Local)
+		os.Exit(1)
+	}
+	s.apply(snap)
+	return s
+}
+
+// next reads the next message, waiting at most a few seconds.
+func (s *subscriber) next() (m message) {
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := s.decoder.Decode(&m); err != nil {
+		m.XMLName.Local = "error: " + err.Error()
+	}
+	return
+}
+
+func (s *subscriber) apply(m message) {
+	s.seq = m.Seq
+	for _, l := range m.Levels {
+		key := l.XMLName.Local + " " + l.Price
+		if l.Shares == "0" {
+			delete(s.book, key)
+		} else {
+			s.book[key] = l.Shares
+		}
+	}
+	if m.Quote != nil {
+		s.quote = *m.Quote
+	}
+	s.trades = append(s.trades, m.Trades...)
+}
+
+// follow applies updates up to seq, which must come one after another.
+func (s *subscriber) follow(seq uint64) {
+	for s.seq < seq {
+		m := s.next()
+		if m.XMLName.Local != "update" || m.Seq != s.seq+1 {
+			failures++
+			fmt.Printf("FAIL update after seq %d: got %s seq %d\n", s.seq, m.XMLName.Local, m.Seq)
+			return
+		}
+		s.apply(m)
+	}
+}
+
+// requestBook returns the levels a <book> request shows, bids then asks.
+func requestBook(addr string, sym string, depth string) []level {
+	request := fmt.Sprintf(`<book sym="%s"/>`, sym)
+	if depth != "" {
+		request = fmt.Sprintf(`<book sym="%s" depth="%s"/>`, sym, depth)
+	}
+	var results struct {
+		Book struct {
+			Levels []level `xml:",any"`
+		} `xml:"book"`
+	}
+	checkError(xml.Unmarshal([]byte(transact(addr, request)), &results))
+	return results.Book.Levels
+}
+
+func expect(what string, got interface{}, want interface{}) {
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		failures++
+		fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+func main() {
+	addr, feed := "127.0.0.1:12345", "127.0.0.1:12346"
+	if len(os.Args) > 2 {
+		addr, feed = os.Args[1], os.Args[2]
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+	seller, buyer, sym := "ms"+run, "mb"+run, "MD"+run
+	transact(addr, fmt.Sprintf(`<create><account id="%s" balance="0"/><account id="%s" balance="100000"/><symbol sym="%s"><account id="%s">1000</account></symbol></create>`, seller, buyer, sym, seller))
+	order := func(acct string, amount int, limit int) {
+		transact(addr, fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="%d" limit="%d"/></transactions>`, acct, sym, amount, limit))
+	}
+
+	first := subscribe(feed, sym)
+	expect("snapshot of an empty book", len(first.book), 0)
+
+	order(seller, -100, 10)
+	order(seller, -50, 11)
+	order(buyer, 30, 9)
+	first.follow(3)
+	expect("depth after three orders", first.book, map[string]string{"ask 10": "100", "ask 11": "50", "bid 9": "30"})
+	expect("quote after three orders", first.quote, quote{Bid: "9", Ask: "10"})
+
+	order(buyer, 40, 10)
+	first.follow(4)
+	expect("trade reported", first.trades, []trade{{Shares: "40", Price: "10"}})
+	expect("depth after the trade", first.book["ask 10"], "60")
+
+	second := subscribe(feed, sym)
+	expect("late snapshot seq", second.seq, 4)
+	expect("late snapshot depth", second.book, first.book)
+	expect("late snapshot last trade", second.trades, []trade{{Shares: "40", Price: "10"}})
+
+	// many requests at once, each numbered in the order it changed the book
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				order(seller, -5, 10+i%4)
+			} else {
+				order(buyer, 5, 8+i%4)
+			}
+		}(i)
+	}
+	wg.Wait()
+	third := subscribe(feed, sym)
+	first.follow(third.seq)
+	expect("updates applied in order give the snapshot", first.book, third.book)
+	expect("quote follows the snapshot", first.quote, third.quote)
+
+	// a <book> request reads the same book
+	requested := make(map[string]string)
+	for _, l := range requestBook(addr, sym, "") {
+		requested[l.XMLName.Local+" "+l.Price] = l.Shares
+	}
+	expect("book request matches the snapshot", requested, third.book)
+	top := requestBook(addr, sym, "1")
+	expect("book request to depth 1", len(top) == 2 && top[0].XMLName.Local == "bid" && top[1].XMLName.Local == "ask", true)
+
+	send(first.conn, fmt.Sprintf(`<unsubscribe sym="%s"/>`, sym))
+	expect("unsubscribe", first.next().XMLName.Local, "unsubscribed")
+
+	if failures > 0 {
+		fmt.Printf("%d market data checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("market data follows the book")
+}
@@ -0,0 +1,24 @@
+#!/usr/bin/env bash
+
+# Runs the matching checks against an exchange that keeps everything in
+# memory, so no Redis or Postgres is needed.
+#
+#     ./memory.sh [port]
+#
+# Uses the matching_engine binary on the PATH; set ENGINE to override.
+
+PORT=${1:-23456}
+ENGINE=${ENGINE:-matching_engine}
+
+$ENGINE -store=memory -listen=127.0.0.1:$PORT -market-data-listen=127.0.0.1:$((PORT + 1)) -admin-token=memory &
+PID=$!
+trap 'kill $PID 2>/dev/null' EXIT
+
+for i in $(seq 50); do
+  (exec 3<>/dev/tcp/127.0.0.1/$PORT) 2>/dev/null && break
+  sleep 0.1
+done
+
+go run priority.go 127.0.0.1:$PORT && go run overspend.go 127.0.0.1:$PORT && go run reports.go 127.0.0.1:$PORT \
+  && go run marketdata.go 127.0.0.1:$PORT 127.0.0.1:$((PORT + 1)) \
+  && go run dump.go 127.0.0.1:$PORT memory && go run json.go 127.0.0.1:$PORT
@@ -0,0 +1,154 @@
+package main
+
+// Checks that concurrent buys from one account can never reserve more cash
+// than the account has, even when they are for different symbols and so
+// match in parallel.
+//
+//     go run overspend.go [host:port]
+//
+// Every run uses fresh account ids and fresh symbols so it can be repeated
+// against a live exchange.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	openedRe = regexp.MustCompile(`<opened id="([^"]+)"`)
+	failures = 0
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// transact sends one request and reads back its <results> block.
+func transact(addr string, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	defer conn.Close()
+
+	body := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + request
+	fmt.Fprintf(conn, "%d\n%s", len(body), body)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp := ""
+	for !strings.Contains(resp, "</results>") {
+		line, err := reader.ReadString('\n')
+		resp += line
+		if err != nil {
+			break
+		}
+	}
+	return resp
+}
+
+// buy returns the id of the order if it was opened.
+func buy(addr string, acct string, sym string, amount int, limit string) string {
+	resp := transact(addr, fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="%d" limit="%s"/></transactions>`, acct, sym, amount, limit))
+	if m := openedRe.FindStringSubmatch(resp); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// buyAll sends one buy per symbol at the same time and returns those that
+// were opened, by symbol.
+func buyAll(addr string, acct string, syms []string, amount int, limit string) map[string]string {
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	opened := make(map[string]string)
+	for _, sym := range syms {
+		wg.Add(1)
+		go func(sym string) {
+			defer wg.Done()
+			if id := buy(addr, acct, sym, amount, limit); id != "" {
+				mux.Lock()
+				opened[sym] = id
+				mux.Unlock()
+			}
+		}(sym)
+	}
+	wg.Wait()
+	return opened
+}
+
+func expect(what string, got int, want int) {
+	if got != want {
+		failures++
+		fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+func main() {
+	addr := "127.0.0.1:12345"
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+	acct := "os" + run
+	syms := []string{}
+	for i := 0; i < 8; i++ {
+		syms = append(syms, fmt.Sprintf("OS%s%c", run, 'A'+i))
+	}
+
+	create := fmt.Sprintf(`<create><account id="%s" balance="1000"/>`, acct)
+	for _, sym := range syms {
+		create += fmt.Sprintf(`<symbol sym="%s"/>`, sym)
+	}
+	transact(addr, create+`</create>`)
+
+	// Nothing sells, so every buy that is accepted rests and keeps its
+	// reservation. 1000 covers one 600 order but never two.
+	opened := buyAll(addr, acct, syms, 6, "100")
+	expect("concurrent 600 buys against 1000 accepted", len(opened), 1)
+	balance := transact(addr, fmt.Sprintf(`<transactions id="%s"><balance/></transactions>`, acct))
+	expect("balance shows 600 reserved, 400 available", boolCount(strings.Contains(balance, `available="400" reserved="600"`)), 1)
+
+	// what is left is available, and no more
+	rest := buy(addr, acct, syms[0], 4, "100")
+	expect("400 buy with 400 available accepted", boolCount(rest != ""), 1)
+	extra := buy(addr, acct, syms[1], 1, "0.01")
+	expect("buy with nothing available accepted", boolCount(extra != ""), 0)
+
+	// canceling releases the reservation exactly once
+	if rest != "" {
+		for i := 0; i < 3; i++ {
+			resp := transact(addr, fmt.Sprintf(`<transactions id="%s"><cancel id="%s"/></transactions>`, acct, rest))
+			if i == 0 && (!strings.Contains(resp, "<canceled>") || strings.Contains(resp, "<error")) {
+				failures++
+				fmt.Println("FAIL cancel of the 400 buy:", resp)
+			}
+		}
+	}
+	opened = buyAll(addr, acct, syms, 4, "100")
+	expect("concurrent 400 buys after cancel accepted", len(opened), 1)
+
+	if failures > 0 {
+		fmt.Printf("%d reservation checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("buying power can't be over-spent")
+}
+
+func boolCount(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
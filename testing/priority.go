@@ -0,0 +1,145 @@
+package main
+
+// Checks that resting orders fill in price-then-time priority.
+//
+//     go run priority.go [host:port]
+//
+// Every run uses fresh account ids and a fresh symbol so it can be repeated
+// against a live exchange.
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	openedRe = regexp.MustCompile(`<opened id="([^"]+)"`)
+	openRe   = regexp.MustCompile(`<open shares="([^"]+)"`)
+	execRe   = regexp.MustCompile(`<executed shares="([^"]+)" price="([^"]+)"`)
+	failures = 0
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// transact sends one request and reads back its <results> or <status> block.
+func transact(addr string, request string) string {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	defer conn.Close()
+
+	body := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + request
+	fmt.Fprintf(conn, "%d\n%s", len(body), body)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	resp := ""
+	for !strings.Contains(resp, "</results>") {
+		line, err := reader.ReadString('\n')
+		resp += line
+		if err != nil {
+			break
+		}
+	}
+	return resp
+}
+
+func order(addr string, acct string, sym string, amount int, limit string) string {
+	resp := transact(addr, fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="%d" limit="%s"/></transactions>`, acct, sym, amount, limit))
+	m := openedRe.FindStringSubmatch(resp)
+	if m == nil {
+		fmt.Println("Order rejected:", resp)
+		os.Exit(1)
+	}
+	return m[1]
+}
+
+// status returns the open and executed share counts for a transaction.
+func status(addr string, acct string, id string) (open float64, executed float64, prices []string) {
+	resp := transact(addr, fmt.Sprintf(`<transactions id="%s"><query id="%s"/></transactions>`, acct, id))
+	if m := openRe.FindStringSubmatch(resp); m != nil {
+		open, _ = strconv.ParseFloat(m[1], 64)
+	}
+	for _, m := range execRe.FindAllStringSubmatch(resp, -1) {
+		shares, _ := strconv.ParseFloat(m[1], 64)
+		executed += shares
+		prices = append(prices, m[2])
+	}
+	return math.Abs(open), math.Abs(executed), prices
+}
+
+func expect(what string, got float64, want float64) {
+	if got != want {
+		failures++
+		fmt.Printf("FAIL %s: got %v, want %v\n", what, got, want)
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+func main() {
+	addr := "127.0.0.1:12345"
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+	sym := "PRIO" + run
+	buyer, seller, lateSeller := "pb"+run, "ps"+run, "pl"+run
+
+	transact(addr, fmt.Sprintf(`<create>
+ <account id="%s" balance="1000000"/>
+ <account id="%s" balance="0"/>
+ <account id="%s" balance="0"/>
+ <symbol sym="%s">
+  <account id="%s">100</account>
+  <account id="%s">100</account>
+ </symbol>
+</create>`, buyer, seller, lateSeller, sym, seller, lateSeller))
+
+	// Twelve single share asks at the same price. Their ids cross from one
+	// digit count to the next often enough that ordering by member string
+	// would put them out of arrival order.
+	sameLevel := []string{}
+	for i := 0; i < 12; i++ {
+		sameLevel = append(sameLevel, order(addr, seller, sym, -1, "100"))
+	}
+	// A better priced ask that arrives last must still fill first.
+	better := order(addr, lateSeller, sym, -5, "99")
+
+	// Takes the better ask and the first ten at 100.
+	order(addr, buyer, sym, 15, "101")
+
+	_, executed, prices := status(addr, lateSeller, better)
+	expect("better priced ask fills first", executed, 5)
+	if len(prices) != 1 || prices[0] != "99" {
+		failures++
+		fmt.Printf("FAIL better priced ask price: got %v, want [99]\n", prices)
+	}
+
+	for i, id := range sameLevel {
+		open, executed, _ := status(addr, seller, id)
+		if i < 10 {
+			expect(fmt.Sprintf("ask #%d (id %s) filled in arrival order", i+1, id), executed, 1)
+		} else {
+			expect(fmt.Sprintf("ask #%d (id %s) still resting", i+1, id), open, 1)
+		}
+	}
+
+	if failures > 0 {
+		fmt.Printf("%d priority checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("price-time priority holds")
+}
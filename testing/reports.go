@@ -0,0 +1,132 @@
+package main
+
+// Checks that fills of resting orders are pushed, unrequested, to the
+// connection that opened them and to connections subscribed to the account.
+//
+//     go run reports.go [host:port]
+//
+// Every run uses fresh account ids and a fresh symbol so it can be repeated
+// against a live exchange.
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	openedRe = regexp.MustCompile(`<opened id="([^"]+)"`)
+	failures = 0
+)
+
+func checkError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+}
+
+// A connection kept open so that reports pushed to it can be read
+type client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dial(addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	checkError(err)
+	return &client{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// transact sends one request and reads up to the end of its <results> block.
+func (c *client) transact(request string) string {
+	body := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + request
+	fmt.Fprintf(c.conn, "%d\n%s", len(body), body)
+	return c.readUntil("</results>", 10*time.Second)
+}
+
+// readUntil reads lines until one contains want or wait has passed.
+func (c *client) readUntil(want string, wait time.Duration) string {
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	resp := ""
+	for !strings.Contains(resp, want) {
+		line, err := c.reader.ReadString('\n')
+		resp += line
+		if err != nil {
+			break
+		}
+	}
+	return resp
+}
+
+func transact(addr string, request string) string {
+	c := dial(addr)
+	defer c.conn.Close()
+	return c.transact(request)
+}
+
+func expect(what string, ok bool, got string) {
+	if !ok {
+		failures++
+		fmt.Printf("FAIL %s, got:\n%s\n", what, got)
+		return
+	}
+	fmt.Printf("ok   %s\n", what)
+}
+
+func main() {
+	addr := "127.0.0.1:12345"
+	if len(os.Args) > 1 {
+		addr = os.Args[1]
+	}
+
+	run := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+	seller, buyer, sym := "rs"+run, "rb"+run, "RP"+run
+	transact(addr, fmt.Sprintf(`<create><account id="%s" balance="0"/><account id="%s" balance="10000"/><symbol sym="%s"><account id="%s">100</account></symbol></create>`, seller, buyer, sym, seller))
+
+	// the seller's own connection rests an order and stays open
+	trader := dial(addr)
+	defer trader.conn.Close()
+	resp := trader.transact(fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="-100" limit="10"/></transactions>`, seller, sym))
+	m := openedRe.FindStringSubmatch(resp)
+	if m == nil {
+		fmt.Println("Error: sell was not opened:", resp)
+		os.Exit(1)
+	}
+	sell := m[1]
+
+	// a second connection only watches the seller's account
+	watcher := dial(addr)
+	defer watcher.conn.Close()
+	resp = watcher.transact(fmt.Sprintf(`<transactions id="%s"><subscribe/></transactions>`, seller))
+	expect("subscribe to an account", strings.Contains(resp, `<subscribed id="`+seller+`">`), resp)
+	resp = watcher.transact(`<transactions id="nobody` + run + `"><subscribe/></transactions>`)
+	expect("subscribe to a missing account refused", strings.Contains(resp, "<error"), resp)
+
+	resp = transact(addr, fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="40" limit="12"/></transactions>`, buyer, sym))
+	expect("incoming buy is answered, not reported", strings.Contains(resp, "<opened") && !strings.Contains(resp, "<executed"), resp)
+
+	want := fmt.Sprintf(`<executed id="%s" sym="%s" shares="-40" price="10" remaining="-60"`, sell, sym)
+	got := trader.readUntil(want, 5*time.Second)
+	expect("fill pushed to the connection that opened the order", strings.Contains(got, want), got)
+	got = watcher.readUntil(want, 5*time.Second)
+	expect("fill pushed to a subscribed connection", strings.Contains(got, want), got)
+
+	// reports stop when the connection goes, and go on for the others
+	trader.conn.Close()
+	transact(addr, fmt.Sprintf(`<transactions id="%s"><order sym="%s" amount="60" limit="10"/></transactions>`, buyer, sym))
+	want = fmt.Sprintf(`<executed id="%s" sym="%s" shares="-60" price="10" remaining="0"`, sell, sym)
+	got = watcher.readUntil(want, 5*time.Second)
+	expect("last fill pushed after another subscriber left", strings.Contains(got, want), got)
+
+	if failures > 0 {
+		fmt.Printf("%d execution report checks failed\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("resting fills are pushed to their accounts' connections")
+}
@@ -0,0 +1,96 @@
+#!/usr/bin/env bash
+
+# Checks that a database error in the middle of a match rolls the whole
+# request back in Postgres. A trigger makes every update to sell_order fail,
+# which happens after the buyer's position and both balances have been
+# written, so none of those may survive. The client was already told the
+# order traded and the cache has the trade, so the exchange must hold the
+# request, and every one after it, until Postgres takes it: once the
+# trigger is gone the next flush applies them all.
+#
+#     ./rollback.sh [host] [port]
+#
+# Needs psql access to the exchange database; set PSQL to override the
+# default of running it inside the compose db service.
+
+HOST=${1:-localhost}
+PORT=${2:-12345}
+PSQL=${PSQL:-"docker-compose exec -T db psql -U postgres -d exchange -tA"}
+
+RUN=$(date +%s%N | tail -c 10)
+SYM="RB$RUN"
+BUYER="rb$RUN"
+SELLER="rs$RUN"
+
+send() {
+  local body="<?xml version=\"1.0\" encoding=\"UTF-8\"?>
+$1"
+  printf '%d\n%s' "${#body}" "$body" | nc -q 1 "$HOST" "$PORT"
+}
+
+sql() {
+  $PSQL -c "$1"
+}
+
+# Requests reach Postgres once the buffer holds 30 of them, so push
+# filler requests through until everything before them is applied.
+flush() {
+  for i in $(seq 31); do
+    send "<create><account id=\"rf$RUN-$1-$i\" balance=\"0\"/></create>" > /dev/null
+  done
+}
+
+send "<create>
+ <account id=\"$BUYER\" balance=\"1000\"/>
+ <account id=\"$SELLER\" balance=\"0\"/>
+ <symbol sym=\"$SYM\"><account id=\"$SELLER\">10</account></symbol>
+</create>" > /dev/null
+send "<transactions id=\"$SELLER\"><order sym=\"$SYM\" amount=\"-10\" limit=\"10\"/></transactions>" > /dev/null
+flush before
+
+sql "CREATE OR REPLACE FUNCTION rollback_test_fail() RETURNS trigger AS \$\$
+BEGIN RAISE EXCEPTION 'injected failure'; END; \$\$ LANGUAGE plpgsql;
+CREATE TRIGGER rollback_test BEFORE UPDATE ON sell_order
+  FOR EACH ROW WHEN (NEW.symbol = '$SYM') EXECUTE PROCEDURE rollback_test_fail();" > /dev/null
+
+response=$(send "<transactions id=\"$BUYER\"><order sym=\"$SYM\" amount=\"10\" limit=\"10\"/></transactions>")
+flush after
+
+failures=0
+expect() {
+  if [ "$2" == "$3" ]; then
+    echo "ok   $1"
+  else
+    echo "FAIL $1: got '$2', want '$3'"
+    failures=$((failures + 1))
+  fi
+}
+
+# what the client and the cache see
+balance() {
+  send "<transactions id=\"$1\"><balance/></transactions>" | grep -o 'total="[^"]*"'
+}
+expect "buyer told the order filled" "$(echo "$response" | grep -c '<opened ')" "1"
+expect "cache has the buyer's payment" "$(balance "$BUYER")" 'total="900"'
+expect "cache has the seller's proceeds" "$(balance "$SELLER")" 'total="100"'
+
+expect "buyer balance untouched" "$(sql "SELECT balance::float FROM account WHERE uid='$BUYER'")" "1000"
+expect "seller balance untouched" "$(sql "SELECT balance::float FROM account WHERE uid='$SELLER'")" "0"
+expect "buyer has no position" "$(sql "SELECT count(*) FROM position WHERE account_id='$BUYER'")" "0"
+expect "sell order still resting" "$(sql "SELECT amount::float FROM sell_order WHERE account_id='$SELLER'")" "-10"
+expect "later requests held back" "$(sql "SELECT count(*) FROM account WHERE uid LIKE 'rf$RUN-after-%'")" "0"
+
+sql "DROP TRIGGER rollback_test ON sell_order; DROP FUNCTION rollback_test_fail();" > /dev/null
+flush retry
+
+expect "buyer balance caught up" "$(sql "SELECT balance::float FROM account WHERE uid='$BUYER'")" "900"
+expect "seller balance caught up" "$(sql "SELECT balance::float FROM account WHERE uid='$SELLER'")" "100"
+expect "buyer position caught up" "$(sql "SELECT amount::float FROM position WHERE account_id='$BUYER'")" "10"
+expect "sell order filled" "$(sql "SELECT count(*) FROM sell_order WHERE account_id='$SELLER'")" "0"
+expect "later requests applied in order" "$(sql "SELECT count(*) FROM account WHERE uid LIKE 'rf$RUN-after-%'")" "31"
+
+if [ $failures -gt 0 ]; then
+  echo "$failures rollback checks failed"
+  exit 1
+fi
+echo "failed match rolled back and held until Postgres took it"
@@ -35,4 +35,54 @@ cat create/sample.txt | nc localhost 12345 && cat transaction/sell/1.txt | nc lo
 echo Stress test with Create/Transactions
 seq 10 | parallel -n0 "cat create/sample.txt | nc localhost 12345 && cat transaction/sell/1.txt | nc localhost 12345 && cat transaction/buy/1.txt | nc localhost 12345"
 
+echo Testing Sample Market Orders
+cat transaction/sell/1.txt | nc localhost 12345 && cat transaction/market/1.txt | nc localhost 12345
+cat transaction/buy/1.txt | nc localhost 12345 && cat transaction/market/2.txt | nc localhost 12345
+
+echo Testing Sample Time In Force
+cat transaction/sell/1.txt | nc localhost 12345 && cat transaction/tif/1.txt | nc localhost 12345
+
+echo Testing Sample Replace
+cat transaction/sell/1.txt | nc localhost 12345 && cat transaction/replace/1.txt | nc localhost 12345
+
+echo Testing Sample Self-Trade Prevention
+cat create/sample.txt | nc localhost 12345 && cat transaction/selftrade/1.txt | nc localhost 12345
+
+echo Testing Sample Account Inquiries
+cat create/sample.txt | nc localhost 12345 && cat transaction/sell/1.txt | nc localhost 12345 && cat transaction/buy/1.txt | nc localhost 12345
+cat transaction/inquiry/1.txt | nc localhost 12345 && cat transaction/inquiry/2.txt | nc localhost 12345
+
+echo Testing Sample Book Requests
+cat transaction/sell/1.txt | nc localhost 12345 && cat book/1.txt | nc localhost 12345 && cat book/2.txt | nc localhost 12345
+
+echo Testing Sample JSON Requests
+cat json/create.txt | nc localhost 12345 && cat json/transactions.txt | nc localhost 12345 && cat json/book.txt | nc localhost 12345
+
+echo Testing Price-Time Priority
+go run priority.go
+
+echo Testing Buying Power Reservations
+go run overspend.go
+
+echo Testing Pushed Execution Reports
+go run reports.go
+
+echo Testing Market Data
+go run marketdata.go
+
+echo Testing Dump Permissions, Filters And Paging
+go run dump.go localhost:12345 "$EME_ADMIN_TOKEN"
+
+echo Testing JSON Alongside XML
+go run json.go
+
+echo Testing Rollback Of A Failed Match
+./rollback.sh
+
+echo Testing Hostile IDs And Symbols
+./hostile.sh
+
+echo Testing Matching On The In-Memory Store
+./memory.sh
+
 echo Conclude test